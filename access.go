@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// who may talk to the bot in DMs
+const (
+	DMAll     = "all"
+	DMNone    = "none"
+	DMMembers = "members"
+)
+
+// AccessConfig lists who may use the bot where.
+// Empty allowlists allow everyone, denylists take precedence over allowlists.
+type AccessConfig struct {
+	AllowGuilds   []string
+	DenyGuilds    []string
+	AllowChannels []string
+	DenyChannels  []string
+	AllowUsers    []string
+	DenyUsers     []string
+	AllowRoles    []string
+	DenyRoles     []string
+	// DMAll, DMNone or DMMembers, the latter only allowing members of allowed guilds
+	DMs string
+	// leave guilds which are not allowed when the bot joins them or starts
+	LeaveGuilds bool
+}
+
+func accessConfigFromEnv() (AccessConfig, error) {
+	c := AccessConfig{
+		AllowGuilds:   envList("ACCESS_ALLOW_GUILDS"),
+		DenyGuilds:    envList("ACCESS_DENY_GUILDS"),
+		AllowChannels: envList("ACCESS_ALLOW_CHANNELS"),
+		DenyChannels:  envList("ACCESS_DENY_CHANNELS"),
+		AllowUsers:    envList("ACCESS_ALLOW_USERS"),
+		DenyUsers:     envList("ACCESS_DENY_USERS"),
+		AllowRoles:    envList("ACCESS_ALLOW_ROLES"),
+		DenyRoles:     envList("ACCESS_DENY_ROLES"),
+		DMs:           envString("ACCESS_DMS", DMAll),
+		LeaveGuilds:   os.Getenv("ACCESS_LEAVE_GUILDS") == "true",
+	}
+	if c.DMs != DMAll && c.DMs != DMNone && c.DMs != DMMembers {
+		return c, fmt.Errorf("ACCESS_DMS must be %q, %q or %q, got %q", DMAll, DMNone, DMMembers, c.DMs)
+	}
+	return c, nil
+}
+
+// listed reports whether one of the values passes the allowlist and none is on the denylist
+func listed(allow, deny []string, values ...string) bool {
+	for _, v := range values {
+		if v != "" && slices.Contains(deny, v) {
+			return false
+		}
+	}
+	if len(allow) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v != "" && slices.Contains(allow, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// GuildAllowed reports whether the bot may be used in the guild
+func (c AccessConfig) GuildAllowed(guildID string) bool {
+	return listed(c.AllowGuilds, c.DenyGuilds, guildID)
+}
+
+// AccessControl decides whether a request is answered.
+// A nil AccessControl allows everything.
+type AccessControl struct {
+	config AccessConfig
+}
+
+func NewAccessControl(c AccessConfig) *AccessControl {
+	return &AccessControl{config: c}
+}
+
+// Allowed reports whether the user with the roles may use the bot in the channel.
+// guildID is empty for DMs.
+func (ac *AccessControl) Allowed(s *discordgo.Session, guildID, channelID, userID string, roles []string) bool {
+	if ac == nil {
+		return true
+	}
+	c := ac.config
+	if !listed(c.AllowUsers, c.DenyUsers, userID) {
+		return false
+	}
+	if guildID == "" {
+		switch c.DMs {
+		case DMNone:
+			return false
+		case DMMembers:
+			return ac.memberOfAllowedGuild(s, userID)
+		}
+		return true
+	}
+	if !c.GuildAllowed(guildID) {
+		return false
+	}
+	// threads are allowed by their parent channel
+	channels := []string{channelID}
+	if ch, err := s.State.Channel(channelID); err == nil && ch.IsThread() {
+		channels = append(channels, ch.ParentID)
+	}
+	return listed(c.AllowChannels, c.DenyChannels, channels...) && listed(c.AllowRoles, c.DenyRoles, roles...)
+}
+
+// memberOfAllowedGuild reports whether the user is a member of an allowed guild the bot is in.
+func (ac *AccessControl) memberOfAllowedGuild(s *discordgo.Session, userID string) bool {
+	for _, g := range s.State.Guilds {
+		if !ac.config.GuildAllowed(g.ID) {
+			continue
+		}
+		if _, err := s.State.Member(g.ID, userID); err == nil {
+			return true
+		}
+		if _, err := s.GuildMember(g.ID, userID); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleGuildCreate leaves the guild if it is not allowed and leaving is enabled.
+// GuildCreate is sent for every guild at startup and when the bot joins a guild.
+func (bot *BaseChatBot) HandleGuildCreate(s *discordgo.Session, g *discordgo.GuildCreate) {
+	ac := bot.access.Load()
+	if ac == nil || !ac.config.LeaveGuilds || ac.config.GuildAllowed(g.ID) {
+		return
+	}
+	bot.logger.Println("Leaving guild which is not allowed:", g.ID, g.Name)
+	if err := s.GuildLeave(g.ID); err != nil {
+		bot.logger.Println("Error leaving guild:", err)
+	}
+}
+
+// AllowInteraction reports whether the user of the interaction may use the bot there
+// and has the permissions of the feature used.
+// Denied interactions are answered with a private message.
+func (bot *BaseChatBot) AllowInteraction(s *discordgo.Session, i *discordgo.InteractionCreate) bool {
+	var roles []string
+	if i.Member != nil {
+		roles = i.Member.Roles
+	}
+	var content string
+	switch feature := interactionFeature(i); {
+	case !bot.access.Load().Allowed(s, i.GuildID, i.ChannelID, interactionUserID(i), roles):
+		content = "You cannot use this bot here."
+	case !bot.permissionConfig().Allowed(feature, i.Member):
+		bot.logger.Println("Denied", feature, "to user", interactionUserID(i), "in channel", i.ChannelID)
+		content = "You do not have permission to do this."
+	default:
+		return true
+	}
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: content,
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		bot.logger.Println("Error responding to interaction:", err)
+	}
+	return false
+}
+
+// functional option to restrict who may use the bot where
+func WithAccessControl(c AccessConfig) ChatBotOption {
+	return func(s *OpenAIChatBot) {
+		s.access.Store(NewAccessControl(c))
+	}
+}
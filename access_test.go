@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/ewohltman/discordgo-mock/mockconstants"
+)
+
+func TestAccessAllowed(t *testing.T) {
+	const thread = "thread"
+	guild, channel, user, role := mockconstants.TestGuild, mockconstants.TestChannel, mockconstants.TestUser, mockconstants.TestRole
+	tests := []struct {
+		name      string
+		config    AccessConfig
+		guildID   string
+		channelID string
+		userID    string
+		roles     []string
+		want      bool
+	}{
+		{"Everyone", AccessConfig{DMs: DMAll}, guild, channel, user, nil, true},
+		{"AllowedGuild", AccessConfig{AllowGuilds: []string{guild}}, guild, channel, user, nil, true},
+		{"OtherGuild", AccessConfig{AllowGuilds: []string{"other"}}, guild, channel, user, nil, false},
+		{"DeniedGuild", AccessConfig{DenyGuilds: []string{guild}}, guild, channel, user, nil, false},
+		{"AllowedChannel", AccessConfig{AllowChannels: []string{channel}}, guild, channel, user, nil, true},
+		{"OtherChannel", AccessConfig{AllowChannels: []string{"other"}}, guild, channel, user, nil, false},
+		{"ThreadOfAllowedChannel", AccessConfig{AllowChannels: []string{channel}}, guild, thread, user, nil, true},
+		{"ThreadOfDeniedChannel", AccessConfig{DenyChannels: []string{channel}}, guild, thread, user, nil, false},
+		{"AllowedUser", AccessConfig{AllowUsers: []string{user}}, guild, channel, user, nil, true},
+		{"DeniedUser", AccessConfig{DenyUsers: []string{user}}, guild, channel, user, nil, false},
+		{"DenyWins", AccessConfig{AllowUsers: []string{user}, DenyUsers: []string{user}}, guild, channel, user, nil, false},
+		{"AllowedRole", AccessConfig{AllowRoles: []string{role}}, guild, channel, user, []string{"other", role}, true},
+		{"NoRole", AccessConfig{AllowRoles: []string{role}}, guild, channel, user, nil, false},
+		{"DeniedRole", AccessConfig{DenyRoles: []string{role}}, guild, channel, user, []string{"other", role}, false},
+		{"DM", AccessConfig{DMs: DMAll}, "", "dm", user, nil, true},
+		{"NoDMs", AccessConfig{DMs: DMNone}, "", "dm", user, nil, false},
+		{"DMOfMember", AccessConfig{DMs: DMMembers}, "", "dm", user, nil, true},
+		{"DMOfStranger", AccessConfig{DMs: DMMembers}, "", "dm", "stranger", nil, false},
+		{"DMOfMemberOfDeniedGuild", AccessConfig{DMs: DMMembers, DenyGuilds: []string{guild}}, "", "dm", user, nil, false},
+		{"DMOfDeniedUser", AccessConfig{DMs: DMAll, DenyUsers: []string{user}}, "", "dm", user, nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newSession()
+			s.State.ChannelAdd(&discordgo.Channel{ID: thread, GuildID: guild, ParentID: channel, Type: discordgo.ChannelTypeGuildPublicThread})
+			got := NewAccessControl(test.config).Allowed(s, test.guildID, test.channelID, test.userID, test.roles)
+			if got != test.want {
+				t.Errorf("expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestAccessReply(t *testing.T) {
+	fake := newFakeOpenAI(t, fakeResponse{Content: "Hi!"})
+	bot, sender := newTestOpenAIChatBot(t, fake, WithAccessControl(AccessConfig{DenyUsers: []string{mockconstants.TestUser}}))
+
+	bot.HandleReply(newSession(), mentionMessage("hello"))
+
+	if len(sender.Messages) != 0 {
+		t.Errorf("expected no reply, got %#v", sender.Messages)
+	}
+	if len(fake.Requests()) != 0 {
+		t.Errorf("expected no request, got %d", len(fake.Requests()))
+	}
+}
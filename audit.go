@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// how message content is written to the audit log
+const (
+	AuditContentNone     = "none"
+	AuditContentRedacted = "redacted"
+	AuditContentFull     = "full"
+)
+
+type AuditConfig struct {
+	// path of the JSONL file. Auditing is disabled if empty.
+	Path string
+	// size in megabytes at which the file is rotated
+	MaxSizeMB int
+	// number of rotated files to keep
+	MaxBackups int
+	// one of AuditContentNone, AuditContentRedacted or AuditContentFull
+	Content string
+}
+
+func auditConfigFromEnv() (AuditConfig, error) {
+	c := AuditConfig{
+		Path:    os.Getenv("AUDIT_LOG"),
+		Content: envString("AUDIT_LOG_CONTENT", AuditContentNone),
+	}
+	var err error
+	if c.MaxSizeMB, err = envInt("AUDIT_LOG_MAX_SIZE_MB", 10); err != nil {
+		return c, err
+	}
+	if c.MaxBackups, err = envInt("AUDIT_LOG_MAX_BACKUPS", 5); err != nil {
+		return c, err
+	}
+	switch c.Content {
+	case AuditContentNone, AuditContentRedacted, AuditContentFull:
+	default:
+		return c, fmt.Errorf("AUDIT_LOG_CONTENT must be one of %q, %q or %q, got %q", AuditContentNone, AuditContentRedacted, AuditContentFull, c.Content)
+	}
+	return c, nil
+}
+
+// One line of the audit log
+type AuditEntry struct {
+	Time             time.Time `json:"time"`
+	Kind             string    `json:"kind"`
+	GuildID          string    `json:"guild_id,omitempty"`
+	ChannelID        string    `json:"channel_id"`
+	UserID           string    `json:"user_id,omitempty"`
+	Model            string    `json:"model"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	TotalTokens      int       `json:"total_tokens"`
+	LatencyMS        int64     `json:"latency_ms"`
+	FinishReason     string    `json:"finish_reason,omitempty"`
+	ErrorClass       string    `json:"error_class,omitempty"`
+	Error            string    `json:"error,omitempty"`
+	// role of the last message sent to the model, which is "tool" for the requests inside the tool calling loop
+	PromptRole string `json:"prompt_role,omitempty"`
+	// last message sent to the model and its answer, depending on AuditConfig.Content
+	Prompt   string `json:"prompt,omitempty"`
+	Response string `json:"response,omitempty"`
+}
+
+// AuditLog writes AuditEntry as JSONL to a file rotated by size.
+type AuditLog struct {
+	config AuditConfig
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func NewAuditLog(c AuditConfig) (*AuditLog, error) {
+	a := &AuditLog{config: c}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.config.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+// rotate renames path to path.1, path.1 to path.2 and so on, dropping files beyond MaxBackups.
+func (a *AuditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	for n := a.config.MaxBackups; n > 0; n-- {
+		src := a.config.Path
+		if n > 1 {
+			src = fmt.Sprintf("%s.%d", a.config.Path, n-1)
+		}
+		if err := os.Rename(src, fmt.Sprintf("%s.%d", a.config.Path, n)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if a.config.MaxBackups <= 0 {
+		if err := os.Remove(a.config.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return a.open()
+}
+
+func (a *AuditLog) Write(entry AuditEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.config.MaxSizeMB > 0 && a.size > 0 && a.size+int64(len(b)) > int64(a.config.MaxSizeMB)<<20 {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(b)
+	a.size += int64(n)
+	return err
+}
+
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// Record writes an entry describing the chat completion request and its outcome.
+func (a *AuditLog) Record(meta requestMeta, req openai.ChatCompletionRequest, resp openai.ChatCompletionResponse, err error, latency time.Duration) error {
+	entry := AuditEntry{
+		Time:             time.Now().UTC(),
+		Kind:             meta.Kind,
+		GuildID:          meta.GuildID,
+		ChannelID:        meta.ChannelID,
+		UserID:           meta.UserID,
+		Model:            req.Model,
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
+		TotalTokens:      resp.Usage.TotalTokens,
+		LatencyMS:        latency.Milliseconds(),
+	}
+	if err != nil {
+		entry.ErrorClass = errorClass(err)
+		entry.Error = err.Error()
+	}
+	var prompt, response string
+	if n := len(req.Messages); n > 0 {
+		prompt = req.Messages[n-1].Content
+		entry.PromptRole = req.Messages[n-1].Role
+	}
+	if len(resp.Choices) > 0 {
+		entry.FinishReason = string(resp.Choices[0].FinishReason)
+		response = resp.Choices[0].Message.Content
+	}
+	entry.Prompt = a.content(prompt)
+	entry.Response = a.content(response)
+	return a.Write(entry)
+}
+
+func (a *AuditLog) content(s string) string {
+	if s == "" {
+		return ""
+	}
+	switch a.config.Content {
+	case AuditContentFull:
+		return s
+	case AuditContentRedacted:
+		return fmt.Sprintf("[redacted len=%d sha256=%x]", len(s), sha256.Sum256([]byte(s)))
+	default:
+		return ""
+	}
+}
+
+// errorClass returns a short, stable description of the kind of err for aggregation.
+func errorClass(err error) string {
+	apiErr := &openai.APIError{}
+	if errors.As(err, &apiErr) {
+		return fmt.Sprintf("api_%d", apiErr.HTTPStatusCode)
+	}
+	reqErr := &openai.RequestError{}
+	if errors.As(err, &reqErr) {
+		return fmt.Sprintf("request_%d", reqErr.HTTPStatusCode)
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	}
+	return "other"
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestAuditRecordContent(t *testing.T) {
+	req := openai.ChatCompletionRequest{
+		Model: "test-model",
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: "system"},
+			{Role: openai.ChatMessageRoleUser, Content: "secret question"},
+		},
+	}
+	resp := openai.ChatCompletionResponse{
+		Choices: []openai.ChatCompletionChoice{
+			{Message: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: "secret answer"}, FinishReason: openai.FinishReasonStop},
+		},
+		Usage: openai.Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15},
+	}
+	tests := []struct {
+		name           string
+		content        string
+		expectedPrompt string
+	}{
+		{"None", AuditContentNone, ""},
+		{"Redacted", AuditContentRedacted, "[redacted len=15 sha256="},
+		{"Full", AuditContentFull, "secret question"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.jsonl")
+			a, err := NewAuditLog(AuditConfig{Path: path, Content: test.content})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer a.Close()
+			meta := requestMeta{Kind: "reply", GuildID: "guild", ChannelID: "channel", UserID: "user"}
+			if err := a.Record(meta, req, resp, nil, 1500*time.Millisecond); err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var entry AuditEntry
+			if err := json.Unmarshal(b, &entry); err != nil {
+				t.Fatal(err)
+			}
+			if entry.Model != "test-model" || entry.TotalTokens != 15 || entry.LatencyMS != 1500 || entry.UserID != "user" || entry.FinishReason != "stop" || entry.PromptRole != "user" {
+				t.Errorf("unexpected entry %#v", entry)
+			}
+			if !strings.HasPrefix(entry.Prompt, test.expectedPrompt) || (test.expectedPrompt == "" && entry.Prompt != "") {
+				t.Errorf("expected prompt %q, got %q", test.expectedPrompt, entry.Prompt)
+			}
+			if test.content != AuditContentFull && strings.Contains(string(b), "secret") {
+				t.Errorf("content leaked into the audit log: %s", b)
+			}
+		})
+	}
+}
+
+func TestAuditRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := NewAuditLog(AuditConfig{Path: path, MaxSizeMB: 1, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	entry := AuditEntry{Error: strings.Repeat("x", 400<<10)}
+	for n := 0; n < 10; n++ {
+		if err := a.Write(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 1<<20 {
+			t.Errorf("%s exceeds the maximum size: %d", p, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected at most 2 backups, got %v", err)
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{"APIError", &openai.APIError{HTTPStatusCode: 429}, "api_429"},
+		{"RequestError", &openai.RequestError{HTTPStatusCode: 502, Err: errors.New("bad gateway")}, "request_502"},
+		{"Other", errors.New("boom"), "other"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := errorClass(test.err); got != test.expected {
+				t.Errorf("errorClass(%v) = %v, want %v", test.err, got, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// percentages of the budget at which the admins are alerted
+var budgetAlertThresholds = []int{50, 80, 100}
+
+// what happens when the budget is used up
+const (
+	BudgetStop      = "stop"
+	BudgetDowngrade = "downgrade"
+)
+
+type BudgetConfig struct {
+	// monthly budget in USD, 0 for no budget
+	MonthlyUSD float64
+	// channel the alerts are posted to, alerts are only logged if empty
+	AlertChannel string
+	// BudgetStop or BudgetDowngrade
+	OnExhausted string
+	// model used when the budget is used up with BudgetDowngrade
+	DowngradeModel string
+	// path of the JSON file keeping the spend of the month across restarts
+	StatePath string
+	// server whose /usage shows the budget, which is not shown anywhere if empty
+	AdminGuild string
+}
+
+func budgetConfigFromEnv() (BudgetConfig, error) {
+	c := BudgetConfig{
+		AlertChannel:   os.Getenv("BUDGET_ALERT_CHANNEL"),
+		OnExhausted:    envString("BUDGET_EXHAUSTED", BudgetStop),
+		DowngradeModel: os.Getenv("BUDGET_DOWNGRADE_MODEL"),
+		StatePath:      envString("BUDGET_STATE", "budget.json"),
+		AdminGuild:     os.Getenv("BUDGET_ADMIN_GUILD"),
+	}
+	var err error
+	if c.MonthlyUSD, err = envFloat("BUDGET_MONTHLY_USD", 0); err != nil {
+		return c, err
+	}
+	switch {
+	case c.MonthlyUSD < 0:
+		return c, errors.New("BUDGET_MONTHLY_USD must not be negative")
+	case c.OnExhausted != BudgetStop && c.OnExhausted != BudgetDowngrade:
+		return c, fmt.Errorf("BUDGET_EXHAUSTED must be %q or %q, got %q", BudgetStop, BudgetDowngrade, c.OnExhausted)
+	case c.OnExhausted == BudgetDowngrade && c.DowngradeModel == "":
+		return c, errors.New("BUDGET_DOWNGRADE_MODEL is required to downgrade")
+	case c.MonthlyUSD > 0 && os.Getenv("USAGE_PRICES") == "":
+		// the spend is estimated from the prices, without them the budget would never be used up
+		return c, errors.New("USAGE_PRICES is required for BUDGET_MONTHLY_USD")
+	}
+	return c, nil
+}
+
+// budgetState is persisted to BudgetConfig.StatePath
+type budgetState struct {
+	// month as YYYY-MM in UTC
+	Month    string  `json:"month"`
+	SpentUSD float64 `json:"spent_usd"`
+	// thresholds already alerted this month
+	Alerted []int `json:"alerted"`
+}
+
+// Budget tracks the estimated spend of the calendar month against the monthly budget.
+type Budget struct {
+	config BudgetConfig
+	now    func() time.Time
+
+	mu    sync.Mutex
+	state budgetState
+}
+
+// NewBudget returns a budget continuing from the state file if it exists.
+func NewBudget(c BudgetConfig) (*Budget, error) {
+	b := &Budget{config: c, now: time.Now}
+	data, err := os.ReadFile(c.StatePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &b.state); err != nil {
+		return nil, fmt.Errorf("%s: %w", c.StatePath, err)
+	}
+	return b, nil
+}
+
+// rollover starts a new month if needed. mu must be held.
+func (b *Budget) rollover() {
+	if month := b.now().UTC().Format("2006-01"); b.state.Month != month {
+		b.state = budgetState{Month: month}
+	}
+}
+
+// Add adds the cost of a request and returns the thresholds crossed by it.
+func (b *Budget) Add(cost float64) ([]int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollover()
+	b.state.SpentUSD += cost
+	var crossed []int
+	for _, t := range budgetAlertThresholds {
+		if b.state.SpentUSD >= b.config.MonthlyUSD*float64(t)/100 && !slices.Contains(b.state.Alerted, t) {
+			b.state.Alerted = append(b.state.Alerted, t)
+			crossed = append(crossed, t)
+		}
+	}
+	return crossed, b.save()
+}
+
+// save writes the state atomically. mu must be held.
+func (b *Budget) save() error {
+	data, err := json.Marshal(b.state)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(b.config.StatePath), ".budget-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), b.config.StatePath)
+}
+
+// Spent returns the spend of the current month in USD
+func (b *Budget) Spent() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollover()
+	return b.state.SpentUSD
+}
+
+func (b *Budget) Exhausted() bool {
+	return b.Spent() >= b.config.MonthlyUSD
+}
+
+// Model returns the model to use instead of model, or a userFacingError if requests are stopped.
+func (b *Budget) Model(model string) (string, error) {
+	if !b.Exhausted() {
+		return model, nil
+	}
+	if b.config.OnExhausted == BudgetDowngrade {
+		return b.config.DowngradeModel, nil
+	}
+	return "", &userFacingError{"The monthly budget of this bot is used up. Please try again next month."}
+}
+
+// String describes the spend for /usage
+func (b *Budget) String() string {
+	return fmt.Sprintf("Monthly budget: $%.2f of $%.2f used", b.Spent(), b.config.MonthlyUSD)
+}
+
+// alertMessage returns the message posted when the threshold is crossed
+func (b *Budget) alertMessage(threshold int) string {
+	spend := fmt.Sprintf("$%.2f of $%.2f", b.Spent(), b.config.MonthlyUSD)
+	if threshold < 100 {
+		return fmt.Sprintf("⚠️ %d%% of the monthly budget is used (%s).", threshold, spend)
+	}
+	if b.config.OnExhausted == BudgetDowngrade {
+		return fmt.Sprintf("🛑 The monthly budget is used up (%s). Replies use `%s` until next month.", spend, b.config.DowngradeModel)
+	}
+	return fmt.Sprintf("🛑 The monthly budget is used up (%s). Replies are stopped until next month.", spend)
+}
+
+// functional option to enforce a monthly spend budget.
+// The budget is disabled if c.MonthlyUSD is 0.
+func WithBudget(c BudgetConfig) ChatBotOption {
+	return func(s *OpenAIChatBot) {
+		if c.MonthlyUSD == 0 {
+			return
+		}
+		b, err := NewBudget(c)
+		if err != nil {
+			s.logger.Fatal("Error loading budget state: ", err)
+		}
+		s.budget.Store(b)
+	}
+}
+
+// spend adds the cost of a request to the budget and alerts the admins of the thresholds crossed.
+func (bot *OpenAIChatBot) spend(meta requestMeta, cost float64) {
+	budget := bot.budget.Load()
+	if budget == nil {
+		return
+	}
+	crossed, err := budget.Add(cost)
+	if err != nil {
+		bot.logger.Println("Error saving budget state:", err)
+	}
+	for _, t := range crossed {
+		msg := budget.alertMessage(t)
+		bot.logger.Println("Budget alert:", msg)
+		if budget.config.AlertChannel == "" || meta.Session == nil {
+			continue
+		}
+		if _, err := bot.sender.ChannelSend(meta.Session, budget.config.AlertChannel, msg); err != nil {
+			bot.logger.Println("Error sending budget alert:", err)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ewohltman/discordgo-mock/mockconstants"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestBudget(t *testing.T) {
+	config := BudgetConfig{MonthlyUSD: 10, OnExhausted: BudgetStop, StatePath: filepath.Join(t.TempDir(), "budget.json")}
+	b, err := NewBudget(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 10, 30, 12, 0, 0, 0, time.UTC)
+	b.now = func() time.Time { return now }
+
+	steps := []struct {
+		cost    float64
+		crossed []int
+	}{
+		{4, nil},
+		{4.5, []int{50, 80}},
+		{1, nil},
+		{0.5, []int{100}},
+		{1, nil},
+	}
+	for n, step := range steps {
+		crossed, err := b.Add(step.cost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(crossed, step.crossed) {
+			t.Errorf("step %d: expected %v to be crossed, got %v", n, step.crossed, crossed)
+		}
+	}
+	if _, err := b.Model("m"); err == nil {
+		t.Error("expected requests to be stopped")
+	}
+
+	// the spend survives a restart
+	restarted, err := NewBudget(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted.now = b.now
+	if restarted.Spent() != 11 {
+		t.Errorf("expected $11 spent, got %v", restarted.Spent())
+	}
+	if crossed, _ := restarted.Add(1); len(crossed) != 0 {
+		t.Errorf("expected no repeated alerts, got %v", crossed)
+	}
+
+	now = now.AddDate(0, 0, 2)
+	if restarted.Spent() != 0 || restarted.Exhausted() {
+		t.Errorf("expected a new month to start with no spend, got %v", restarted.Spent())
+	}
+}
+
+func TestBudgetConfigFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{"Disabled", nil, false},
+		{"Stop", map[string]string{"BUDGET_MONTHLY_USD": "25.5", "USAGE_PRICES": "prices.json"}, false},
+		{"Downgrade", map[string]string{"BUDGET_MONTHLY_USD": "25", "BUDGET_EXHAUSTED": "downgrade", "BUDGET_DOWNGRADE_MODEL": "small", "USAGE_PRICES": "prices.json"}, false},
+		{"DowngradeWithoutModel", map[string]string{"BUDGET_MONTHLY_USD": "25", "BUDGET_EXHAUSTED": "downgrade", "USAGE_PRICES": "prices.json"}, true},
+		{"UnknownAction", map[string]string{"BUDGET_MONTHLY_USD": "25", "BUDGET_EXHAUSTED": "panic", "USAGE_PRICES": "prices.json"}, true},
+		{"WithoutPrices", map[string]string{"BUDGET_MONTHLY_USD": "25"}, true},
+		{"Negative", map[string]string{"BUDGET_MONTHLY_USD": "-1"}, true},
+		{"NotANumber", map[string]string{"BUDGET_MONTHLY_USD": "ten"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{"BUDGET_MONTHLY_USD", "BUDGET_EXHAUSTED", "BUDGET_DOWNGRADE_MODEL", "USAGE_PRICES"} {
+				t.Setenv(name, test.env[name])
+			}
+			if _, err := budgetConfigFromEnv(); (err != nil) != test.wantErr {
+				t.Errorf("returned %v, want error: %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestBudgetReply(t *testing.T) {
+	tests := []struct {
+		name        string
+		onExhausted string
+		replies     []string
+		models      []string
+		// messages in the context of the channel afterwards, a stopped prompt is not kept
+		context int
+	}{
+		{"Stop", BudgetStop, []string{"Hi!\n", "The monthly budget of this bot is used up. Please try again next month."}, []string{defaultModel}, 3},
+		{"Downgrade", BudgetDowngrade, []string{"Hi!\n", "Hi again!\n"}, []string{defaultModel, "small-model"}, 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			usage := openai.Usage{PromptTokens: 1_000_000, CompletionTokens: 0}
+			fake := newFakeOpenAI(t, fakeResponse{Content: "Hi!", Usage: usage}, fakeResponse{Content: "Hi again!", Usage: usage})
+			bot, sender := newTestOpenAIChatBot(t, fake,
+				WithUsage(UsageConfig{Prices: PriceTable{defaultModel: {Input: 2}}}),
+				WithBudget(BudgetConfig{
+					MonthlyUSD:     2,
+					AlertChannel:   "admin",
+					OnExhausted:    test.onExhausted,
+					DowngradeModel: "small-model",
+					StatePath:      filepath.Join(t.TempDir(), "budget.json"),
+				}),
+			)
+			s := newSession()
+
+			bot.HandleReply(s, mentionMessage("hello"))
+			bot.HandleReply(s, mentionMessage("hello again"))
+
+			if got := sender.Messages[mockconstants.TestChannel]; !slices.Equal(got, test.replies) {
+				t.Errorf("expected replies %#v, got %#v", test.replies, got)
+			}
+			alerts := sender.Messages["admin"]
+			if len(alerts) != 3 || !strings.Contains(alerts[2], "The monthly budget is used up ($2.00 of $2.00)") {
+				t.Errorf("expected 3 alerts, got %#v", alerts)
+			}
+			var models []string
+			for _, req := range fake.Requests() {
+				models = append(models, req.Model)
+			}
+			if !slices.Equal(models, test.models) {
+				t.Errorf("expected requests with %v, got %v", test.models, models)
+			}
+			if c := bot.chatContext[mockconstants.TestChannel]; len(c.Messages) != test.context {
+				t.Errorf("expected %d messages in the context, got %#v", test.context, c.Messages)
+			}
+		})
+	}
+}
+
+func TestBudgetUsage(t *testing.T) {
+	tests := []struct {
+		name       string
+		adminGuild string
+		shown      bool
+	}{
+		{"AdminGuild", mockconstants.TestGuild, true},
+		{"OtherGuild", "admin guild", false},
+		{"NoAdminGuild", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bot, _ := newTestOpenAIChatBot(t, newFakeOpenAI(t), WithBudget(BudgetConfig{
+				MonthlyUSD:  2,
+				OnExhausted: BudgetStop,
+				StatePath:   filepath.Join(t.TempDir(), "budget.json"),
+				AdminGuild:  test.adminGuild,
+			}))
+			s := newSession()
+			recorder := recordInteractions(s)
+
+			bot.ShowUsage(s, commandInteraction("usage"))
+
+			got := recorder.Responses()
+			if len(got) != 1 {
+				t.Fatalf("expected 1 interaction response, got %#v", got)
+			}
+			if shown := strings.Contains(got[0], "Monthly budget: $0.00 of $2.00 used"); shown != test.shown {
+				t.Errorf("expected the budget to be shown: %v, got %q", test.shown, got[0])
+			}
+		})
+	}
+}
+
+func TestBudgetUnpricedModel(t *testing.T) {
+	fake := newFakeOpenAI(t, fakeResponse{Content: "Hi!", Usage: openai.Usage{PromptTokens: 1_000_000}})
+	logger := &MockLogger{}
+	bot, _ := newTestOpenAIChatBot(t, fake,
+		WithLogger(logger),
+		WithUsage(UsageConfig{Prices: PriceTable{"other-model": {Input: 2}}}),
+		WithBudget(BudgetConfig{MonthlyUSD: 2, OnExhausted: BudgetStop, StatePath: filepath.Join(t.TempDir(), "budget.json")}),
+	)
+
+	bot.HandleReply(newSession(), mentionMessage("hello"))
+
+	if !slices.ContainsFunc(logger.GetPrintLogs(), func(l string) bool { return strings.Contains(l, "has no price in USAGE_PRICES") }) {
+		t.Errorf("expected the unpriced model to be logged, got %#v", logger.GetPrintLogs())
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"regexp"
 	"strings"
+	"sync/atomic"
 
 	"github.com/bwmarrin/discordgo"
 	openai "github.com/sashabaranov/go-openai"
@@ -15,6 +16,35 @@ type IchatBot interface {
 	Reply(prompt string, s *discordgo.Session, m *discordgo.MessageCreate) (string, error)
 	HandleReply(s *discordgo.Session, m *discordgo.MessageCreate)
 	RemoveContext(s *discordgo.Session, i *discordgo.InteractionCreate)
+	Regenerate(s *discordgo.Session, i *discordgo.InteractionCreate)
+	Continue(s *discordgo.Session, i *discordgo.InteractionCreate)
+	Ask(s *discordgo.Session, i *discordgo.InteractionCreate)
+	HandleReaction(s *discordgo.Session, r *discordgo.MessageReactionAdd)
+	HandleGuildCreate(s *discordgo.Session, g *discordgo.GuildCreate)
+	AllowInteraction(s *discordgo.Session, i *discordgo.InteractionCreate) bool
+	Reload(s Settings) error
+	HandlePinsUpdate(s *discordgo.Session, p *discordgo.ChannelPinsUpdate)
+	HandleKnowledgeMessage(s *discordgo.Session, m *discordgo.MessageCreate)
+	SetPersona(s *discordgo.Session, i *discordgo.InteractionCreate)
+	HandleMessageAction(s *discordgo.Session, i *discordgo.InteractionCreate)
+	Summarize(s *discordgo.Session, i *discordgo.InteractionCreate)
+	ShowUsage(s *discordgo.Session, i *discordgo.InteractionCreate)
+}
+
+// custom IDs of the buttons attached to bot replies
+const (
+	ComponentRegenerate = "reply_regenerate"
+	ComponentContinue   = "reply_continue"
+	ComponentForget     = "reply_forget"
+)
+
+// userFacingError is an error whose message can be shown in Discord as is.
+type userFacingError struct {
+	msg string
+}
+
+func (e *userFacingError) Error() string {
+	return e.msg
 }
 
 // contract for logging
@@ -37,6 +67,8 @@ func (l *DefaultLogger) Fatal(v ...any) {
 type Sender interface {
 	ChannelSend(s *discordgo.Session, channelID string, content string) (*discordgo.Message, error)
 	ReplySend(s *discordgo.Session, channelID string, content string, reference *discordgo.MessageReference) (*discordgo.Message, error)
+	ComplexSend(s *discordgo.Session, channelID string, data *discordgo.MessageSend) (*discordgo.Message, error)
+	FollowupSend(s *discordgo.Session, i *discordgo.Interaction, data *discordgo.WebhookParams) (*discordgo.Message, error)
 }
 
 type DefaultSender struct {
@@ -53,12 +85,37 @@ func (ds *DefaultSender) ReplySend(s *discordgo.Session, channelID string, conte
 	return s.ChannelMessageSendReply(channelID, content, reference)
 }
 
+func (ds *DefaultSender) ComplexSend(s *discordgo.Session, channelID string, data *discordgo.MessageSend) (*discordgo.Message, error) {
+	ds.logger.Println("Sending message:", data.Content)
+	return s.ChannelMessageSendComplex(channelID, data)
+}
+
+func (ds *DefaultSender) FollowupSend(s *discordgo.Session, i *discordgo.Interaction, data *discordgo.WebhookParams) (*discordgo.Message, error) {
+	ds.logger.Println("Sending followup:", data.Content)
+	return s.FollowupMessageCreate(i, true, data)
+}
+
 // Base implementation of HandleReply
 type BaseChatBot struct {
 	ReplyFunc func(string, *discordgo.Session, *discordgo.MessageCreate) (string, error)
 	InitFunc  func() error
-	logger    Logger
-	sender    Sender
+	// RegenerateFunc replaces the last reply in the channel with a new sample
+	RegenerateFunc func(*discordgo.Session, *discordgo.InteractionCreate) (string, error)
+	// ContinueFunc asks the model to keep going from the last reply in the channel
+	ContinueFunc func(*discordgo.Session, *discordgo.InteractionCreate) (string, error)
+	// AskFunc answers a question of the /ask command without the conversation of the channel
+	AskFunc func(string, *discordgo.Session, *discordgo.InteractionCreate) (string, error)
+	// ModelFunc returns the model used for replies in the channel
+	ModelFunc func(channelID string) string
+	// RepliedFunc is called with the message carrying the buttons of a reply sent to the channel
+	RepliedFunc func(channelID string, msg *discordgo.Message)
+	// RedactFunc removes sensitive data from prompts written to the feedback log
+	RedactFunc  func(text string) string
+	logger      Logger
+	sender      Sender
+	feedback    *FeedbackLog
+	access      atomic.Pointer[AccessControl]
+	permissions atomic.Pointer[PermissionConfig]
 }
 
 // This function will be called (due to AddHandler above) every time a new
@@ -80,6 +137,14 @@ func (bot *BaseChatBot) HandleReply(s *discordgo.Session, m *discordgo.MessageCr
 		// ignoring message
 		return
 	}
+	var roles []string
+	if m.Member != nil {
+		roles = m.Member.Roles
+	}
+	if !bot.access.Load().Allowed(s, m.GuildID, m.ChannelID, m.Author.ID, roles) {
+		bot.logger.Println("Ignoring message of user", m.Author.ID, "in channel", m.ChannelID, "which is not allowed")
+		return
+	}
 
 	content := removeMention(m.Content)
 
@@ -89,42 +154,196 @@ func (bot *BaseChatBot) HandleReply(s *discordgo.Session, m *discordgo.MessageCr
 
 	reply, err := bot.ReplyFunc(content, s, m)
 	if err != nil {
-		// opnai API error handling
-		e := &openai.APIError{}
-		if errors.As(err, &e) {
-			switch e.HTTPStatusCode {
-			case 400:
-				if strings.Contains(e.Message, "Please reduce the length of the messages.") {
-					// Initialize the client and clear the message history
-					bot.InitFunc()
-					bot.sender.ChannelSend(s, m.ChannelID, "Cleared the message history as reached maximum token length. Please retry.")
-				}
-			case 401:
-				// invalid auth or key (do not retry)
-				bot.logger.Fatal("Invalid auth or key")
-			case 429:
-				// rate limiting or engine overload (wait and retry)
-				bot.logger.Println(err)
-				bot.sender.ChannelSend(s, m.ChannelID, e.Message)
-			case 500:
-				// openai server error (retry)
-				bot.logger.Println(err)
-				bot.sender.ChannelSend(s, m.ChannelID, e.Message)
-			default:
-				// unhandled
-				bot.sender.ChannelSend(s, m.ChannelID, e.Message)
-				bot.logger.Fatal(err)
+		bot.handleError(s, m.ChannelID, err)
+		return
+	}
+	msgs := bot.sendReply(s, m.ChannelID, reply)
+	bot.trackFeedback(m.GuildID, m.ChannelID, content, reply, msgs)
+}
+
+// Regenerate handles the "Regenerate" button on a bot reply.
+func (bot *BaseChatBot) Regenerate(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	bot.handleComponent(s, i, bot.RegenerateFunc)
+}
+
+// Continue handles the "Continue" button on a bot reply.
+func (bot *BaseChatBot) Continue(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	bot.handleComponent(s, i, bot.ContinueFunc)
+}
+
+func (bot *BaseChatBot) handleComponent(s *discordgo.Session, i *discordgo.InteractionCreate, f func(*discordgo.Session, *discordgo.InteractionCreate) (string, error)) {
+	if f == nil {
+		panic("component handler is not initialized. Specify RegenerateFunc and ContinueFunc in Init().")
+	}
+	// Acknowledge the click first since generating the reply may take longer than the interaction deadline
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredMessageUpdate,
+	})
+	if err != nil {
+		bot.logger.Println("Error responding to interaction:", err)
+	}
+
+	reply, err := f(s, i)
+	if err != nil {
+		bot.handleError(s, i.ChannelID, err)
+		return
+	}
+	msgs := bot.sendReply(s, i.ChannelID, reply)
+	bot.trackFeedback(i.GuildID, i.ChannelID, "", reply, msgs)
+}
+
+// Ask handles the /ask command. The answer is sent as a follow-up to a deferred response, only visible to the user if private is set.
+func (bot *BaseChatBot) Ask(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if bot.AskFunc == nil {
+		panic("AskFunc is not initialized. Specify AskFunc in Init().")
+	}
+	var question string
+	var flags discordgo.MessageFlags
+	for _, o := range i.ApplicationCommandData().Options {
+		switch o.Name {
+		case "question":
+			question = o.StringValue()
+		case "private":
+			if o.BoolValue() {
+				flags = discordgo.MessageFlagsEphemeral
 			}
 		}
-		// TODO: add discord API error handling
-	} else {
-		// split the content so it's less than 2000 characters
-		replies := splitMessage(reply, 2000)
-		for _, r := range replies {
-			bot.sender.ChannelSend(s, m.ChannelID, r)
+	}
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Flags: flags},
+	})
+	if err != nil {
+		bot.logger.Println("Error responding to interaction:", err)
+	}
+
+	reply, err := bot.AskFunc(question, s, i)
+	if err != nil {
+		reply = bot.interactionError(err)
+	}
+	bot.sendFollowup(s, i, reply, flags)
+}
+
+// sendFollowup sends the content as follow-up messages of the interaction.
+// It returns the messages successfully sent.
+func (bot *BaseChatBot) sendFollowup(s *discordgo.Session, i *discordgo.InteractionCreate, content string, flags discordgo.MessageFlags) []*discordgo.Message {
+	var msgs []*discordgo.Message
+	for _, r := range splitMessage(content, 2000) {
+		msg, err := bot.sender.FollowupSend(s, i.Interaction, &discordgo.WebhookParams{Content: r, Flags: flags})
+		if err != nil {
+			bot.logger.Println("Error sending followup:", err)
+			continue
 		}
+		msgs = append(msgs, msg)
 	}
+	return msgs
+}
 
+// interactionError returns the message shown to the user of an interaction that failed.
+// Unlike handleError it does not post to the channel, since the response may be private.
+func (bot *BaseChatBot) interactionError(err error) string {
+	bot.logger.Println(err)
+	e := &openai.APIError{}
+	if errors.As(err, &e) {
+		return e.Message
+	}
+	u := &userFacingError{}
+	if errors.As(err, &u) {
+		return u.Error()
+	}
+	return "Sorry, something went wrong while answering."
+}
+
+// sendReply sends the reply to the channel and attaches the reply buttons to the last message.
+// It returns the messages successfully sent.
+func (bot *BaseChatBot) sendReply(s *discordgo.Session, channelID string, reply string) []*discordgo.Message {
+	// split the content so it's less than 2000 characters
+	replies := splitMessage(reply, 2000)
+	var msgs []*discordgo.Message
+	for n, r := range replies {
+		var msg *discordgo.Message
+		var err error
+		if n < len(replies)-1 {
+			msg, err = bot.sender.ChannelSend(s, channelID, r)
+		} else {
+			msg, err = bot.sender.ComplexSend(s, channelID, &discordgo.MessageSend{
+				Content:    r,
+				Components: replyComponents(),
+			})
+			if err == nil && msg != nil && bot.RepliedFunc != nil {
+				bot.RepliedFunc(channelID, msg)
+			}
+		}
+		if err != nil {
+			bot.logger.Println("Error sending reply:", err)
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func replyComponents() []discordgo.MessageComponent {
+	return []discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "Regenerate",
+					Style:    discordgo.SecondaryButton,
+					CustomID: ComponentRegenerate,
+				},
+				discordgo.Button{
+					Label:    "Continue",
+					Style:    discordgo.SecondaryButton,
+					CustomID: ComponentContinue,
+				},
+				discordgo.Button{
+					Label:    "Forget",
+					Style:    discordgo.DangerButton,
+					CustomID: ComponentForget,
+				},
+			},
+		},
+	}
+}
+
+func (bot *BaseChatBot) handleError(s *discordgo.Session, channelID string, err error) {
+	// opnai API error handling
+	e := &openai.APIError{}
+	if errors.As(err, &e) {
+		switch e.HTTPStatusCode {
+		case 400:
+			if strings.Contains(e.Message, "Please reduce the length of the messages.") {
+				// Initialize the client and clear the message history
+				bot.InitFunc()
+				bot.sender.ChannelSend(s, channelID, "Cleared the message history as reached maximum token length. Please retry.")
+			}
+		case 401:
+			// invalid auth or key (do not retry). The key pool has disabled the key.
+			bot.logger.Println(err)
+			bot.sender.ChannelSend(s, channelID, "The OpenAI API key was rejected. Please ask the owner of the bot to check the keys.")
+		case 429:
+			// rate limiting or engine overload (wait and retry)
+			bot.logger.Println(err)
+			bot.sender.ChannelSend(s, channelID, e.Message)
+		case 500:
+			// openai server error (retry)
+			bot.logger.Println(err)
+			bot.sender.ChannelSend(s, channelID, e.Message)
+		default:
+			// unhandled
+			bot.sender.ChannelSend(s, channelID, e.Message)
+			bot.logger.Fatal(err)
+		}
+		return
+	}
+	u := &userFacingError{}
+	if errors.As(err, &u) {
+		bot.sender.ChannelSend(s, channelID, u.Error())
+		return
+	}
+	// TODO: add discord API error handling
+	bot.logger.Println(err)
 }
 
 func isTalkingToBot(s *discordgo.Session, m *discordgo.MessageCreate) (bool, error) {
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strings"
 	"testing"
 
 	"github.com/bwmarrin/discordgo"
@@ -45,6 +46,10 @@ func (m *MockLogger) GetFatalLogs() []string {
 // mock implementation of sender interface
 type MockSender struct {
 	Messages map[string][]string
+	// messages sent with ComplexSend
+	Complex map[string][]*discordgo.MessageSend
+	// follow-up messages of interactions
+	Followups []*discordgo.WebhookParams
 }
 
 func (ms *MockSender) ChannelSend(s *discordgo.Session, channelID string, content string) (*discordgo.Message, error) {
@@ -59,6 +64,21 @@ func (ms *MockSender) ReplySend(s *discordgo.Session, channelID string, content
 	return ms.ChannelSend(s, channelID, content)
 }
 
+func (ms *MockSender) ComplexSend(s *discordgo.Session, channelID string, data *discordgo.MessageSend) (*discordgo.Message, error) {
+	if ms.Complex == nil {
+		ms.Complex = make(map[string][]*discordgo.MessageSend)
+	}
+	ms.Complex[channelID] = append(ms.Complex[channelID], data)
+	ms.ChannelSend(s, channelID, data.Content)
+	// replies are identified by the message carrying the buttons
+	return &discordgo.Message{ID: fmt.Sprint("reply-", len(ms.Complex[channelID])), ChannelID: channelID, Content: data.Content}, nil
+}
+
+func (ms *MockSender) FollowupSend(s *discordgo.Session, i *discordgo.Interaction, data *discordgo.WebhookParams) (*discordgo.Message, error) {
+	ms.Followups = append(ms.Followups, data)
+	return nil, nil
+}
+
 func TestRemoveMention(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -245,6 +265,45 @@ func TestHandleReply(t *testing.T) {
 	}
 }
 
+func TestSendReplyComponents(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+	}{
+		{"Short", "Test reply"},
+		{"Split", strings.Repeat("0123456789\n", 300)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mockSender := MockSender{}
+			chatbot := BaseChatBot{logger: &MockLogger{}, sender: &mockSender}
+			chatbot.sendReply(newSession(), mockconstants.TestChannel, test.reply)
+
+			expected := len(splitMessage(test.reply, 2000))
+			if got := len(mockSender.Messages[mockconstants.TestChannel]); got != expected {
+				t.Fatalf("expected %d messages, got %d", expected, got)
+			}
+			complex := mockSender.Complex[mockconstants.TestChannel]
+			if len(complex) != 1 {
+				t.Errorf("expected 1 message with components, got %d", len(complex))
+			}
+			// only the last message carries the buttons
+			row, ok := complex[len(complex)-1].Components[0].(discordgo.ActionsRow)
+			if !ok {
+				t.Fatalf("expected an actions row, got %#v", complex[len(complex)-1].Components[0])
+			}
+			var ids []string
+			for _, c := range row.Components {
+				ids = append(ids, c.(discordgo.Button).CustomID)
+			}
+			buttons := []string{ComponentRegenerate, ComponentContinue, ComponentForget}
+			if strings.Join(ids, ",") != strings.Join(buttons, ",") {
+				t.Errorf("expected buttons %v, got %v", buttons, ids)
+			}
+		})
+	}
+}
+
 func newSession() *discordgo.Session {
 	state, err := newState()
 	if err != nil {
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFile is the YAML configuration file.
+// Each setting is applied as the environment variable in its env tag
+// unless that variable is already set in the environment of the process.
+// Settings marked "restart" are only read at startup.
+type ConfigFile struct {
+	// model of the personas which do not set one
+	Model    string `yaml:"model" env:"DEFAULT_MODEL"`
+	Personas struct {
+		Dir     string `yaml:"dir" env:"PERSONAS_DIR"`
+		Default string `yaml:"default" env:"PERSONA_DEFAULT"`
+	} `yaml:"personas"`
+	// "thread" to answer message actions in threads
+	MessageActionReply string `yaml:"message_action_reply" env:"MESSAGE_ACTION_REPLY"`
+	// restart
+	FeedbackLog string `yaml:"feedback_log" env:"FEEDBACK_LOG"`
+	// restart
+	Audit struct {
+		Path       string `yaml:"path" env:"AUDIT_LOG"`
+		Content    string `yaml:"content" env:"AUDIT_LOG_CONTENT"`
+		MaxSizeMB  *int   `yaml:"max_size_mb" env:"AUDIT_LOG_MAX_SIZE_MB"`
+		MaxBackups *int   `yaml:"max_backups" env:"AUDIT_LOG_MAX_BACKUPS"`
+	} `yaml:"audit"`
+	// restart
+	Tools struct {
+		MaxIterations  *int   `yaml:"max_iterations" env:"TOOL_MAX_ITERATIONS"`
+		TimeoutSeconds *int   `yaml:"timeout_seconds" env:"TOOL_TIMEOUT_SECONDS"`
+		MCPConfig      string `yaml:"mcp_config" env:"MCP_CONFIG"`
+	} `yaml:"tools"`
+	// restart
+	RAG struct {
+		Index           string   `yaml:"index" env:"RAG_INDEX"`
+		Channels        []string `yaml:"channels" env:"RAG_CHANNELS"`
+		TopK            *int     `yaml:"top_k" env:"RAG_TOP_K"`
+		MinScorePercent *int     `yaml:"min_score_percent" env:"RAG_MIN_SCORE_PERCENT"`
+	} `yaml:"rag"`
+	// restart
+	Knowledge struct {
+		Pins     *bool    `yaml:"pins" env:"KNOWLEDGE_PINS"`
+		Channels []string `yaml:"channels" env:"KNOWLEDGE_CHANNELS"`
+		MaxChars *int     `yaml:"max_chars" env:"KNOWLEDGE_MAX_CHARS"`
+	} `yaml:"knowledge"`
+	// restart
+	Usage struct {
+		Log    string `yaml:"log" env:"USAGE_LOG"`
+		Prices string `yaml:"prices" env:"USAGE_PRICES"`
+	} `yaml:"usage"`
+	Limits struct {
+		UserRPM            *int     `yaml:"user_rpm" env:"RATE_LIMIT_USER_RPM"`
+		ChannelRPM         *int     `yaml:"channel_rpm" env:"RATE_LIMIT_CHANNEL_RPM"`
+		GuildRPM           *int     `yaml:"guild_rpm" env:"RATE_LIMIT_GUILD_RPM"`
+		UserDailyTokens    *int     `yaml:"user_daily_tokens" env:"QUOTA_USER_DAILY_TOKENS"`
+		ChannelDailyTokens *int     `yaml:"channel_daily_tokens" env:"QUOTA_CHANNEL_DAILY_TOKENS"`
+		GuildDailyTokens   *int     `yaml:"guild_daily_tokens" env:"QUOTA_GUILD_DAILY_TOKENS"`
+		ExemptRoles        []string `yaml:"exempt_roles" env:"RATE_LIMIT_EXEMPT_ROLES"`
+	} `yaml:"limits"`
+	Budget struct {
+		MonthlyUSD     *float64 `yaml:"monthly_usd" env:"BUDGET_MONTHLY_USD"`
+		AlertChannel   string   `yaml:"alert_channel" env:"BUDGET_ALERT_CHANNEL"`
+		OnExhausted    string   `yaml:"on_exhausted" env:"BUDGET_EXHAUSTED"`
+		DowngradeModel string   `yaml:"downgrade_model" env:"BUDGET_DOWNGRADE_MODEL"`
+		State          string   `yaml:"state" env:"BUDGET_STATE"`
+		AdminGuild     string   `yaml:"admin_guild" env:"BUDGET_ADMIN_GUILD"`
+	} `yaml:"budget"`
+	Access struct {
+		AllowGuilds   []string `yaml:"allow_guilds" env:"ACCESS_ALLOW_GUILDS"`
+		DenyGuilds    []string `yaml:"deny_guilds" env:"ACCESS_DENY_GUILDS"`
+		AllowChannels []string `yaml:"allow_channels" env:"ACCESS_ALLOW_CHANNELS"`
+		DenyChannels  []string `yaml:"deny_channels" env:"ACCESS_DENY_CHANNELS"`
+		AllowUsers    []string `yaml:"allow_users" env:"ACCESS_ALLOW_USERS"`
+		DenyUsers     []string `yaml:"deny_users" env:"ACCESS_DENY_USERS"`
+		AllowRoles    []string `yaml:"allow_roles" env:"ACCESS_ALLOW_ROLES"`
+		DenyRoles     []string `yaml:"deny_roles" env:"ACCESS_DENY_ROLES"`
+		DMs           string   `yaml:"dms" env:"ACCESS_DMS"`
+		LeaveGuilds   *bool    `yaml:"leave_guilds" env:"ACCESS_LEAVE_GUILDS"`
+	} `yaml:"access"`
+	Permissions struct {
+		Forget       []string `yaml:"forget" env:"PERMISSIONS_FORGET"`
+		ForgetRoles  []string `yaml:"forget_roles" env:"PERMISSIONS_FORGET_ROLES"`
+		Persona      []string `yaml:"persona" env:"PERMISSIONS_PERSONA"`
+		PersonaRoles []string `yaml:"persona_roles" env:"PERMISSIONS_PERSONA_ROLES"`
+		Usage        []string `yaml:"usage" env:"PERMISSIONS_USAGE"`
+		UsageRoles   []string `yaml:"usage_roles" env:"PERMISSIONS_USAGE_ROLES"`
+	} `yaml:"permissions"`
+	Moderation struct {
+		Classifier string   `yaml:"classifier" env:"MODERATION"`
+		Model      string   `yaml:"model" env:"MODERATION_MODEL"`
+		Wordlist   string   `yaml:"wordlist" env:"MODERATION_WORDLIST"`
+		Action     string   `yaml:"action" env:"MODERATION_ACTION"`
+		Threshold  *float64 `yaml:"threshold" env:"MODERATION_THRESHOLD"`
+		Thresholds string   `yaml:"thresholds" env:"MODERATION_THRESHOLDS"`
+		LogChannel string   `yaml:"log_channel" env:"MODERATION_LOG_CHANNEL"`
+	} `yaml:"moderation"`
+	Redaction struct {
+		Detectors []string `yaml:"detectors" env:"REDACTION"`
+		Patterns  string   `yaml:"patterns" env:"REDACTION_PATTERNS"`
+		Warn      *bool    `yaml:"warn" env:"REDACTION_WARN"`
+	} `yaml:"redaction"`
+	Injection struct {
+		Detection string `yaml:"detection" env:"INJECTION_DETECTION"`
+		Patterns  string `yaml:"patterns" env:"INJECTION_PATTERNS"`
+	} `yaml:"injection"`
+}
+
+// loadConfigFile parses the configuration file, rejecting unknown settings
+func loadConfigFile(path string) (*ConfigFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &ConfigFile{}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(f); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return f, nil
+}
+
+// configField is a setting of the configuration file
+type configField struct {
+	// dotted path of the setting in the file such as budget.monthly_usd
+	key   string
+	env   string
+	value reflect.Value
+}
+
+// configFields returns the settings of the file in the order they are declared
+func configFields(v reflect.Value, prefix string) []configField {
+	var fields []configField
+	for n := 0; n < v.NumField(); n++ {
+		f := v.Type().Field(n)
+		key := prefix + strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if env := f.Tag.Get("env"); env != "" {
+			fields = append(fields, configField{key: key, env: env, value: v.Field(n)})
+		} else if f.Type.Kind() == reflect.Struct {
+			fields = append(fields, configFields(v.Field(n), key+".")...)
+		}
+	}
+	return fields
+}
+
+// Env returns the environment variables of the settings present in the file.
+// Lists are joined with commas.
+func (f *ConfigFile) Env() map[string]string {
+	env := make(map[string]string)
+	for _, field := range configFields(reflect.ValueOf(f).Elem(), "") {
+		v := field.value
+		switch v.Kind() {
+		case reflect.String:
+			if v.String() != "" {
+				env[field.env] = v.String()
+			}
+		case reflect.Slice:
+			if !v.IsNil() {
+				env[field.env] = strings.Join(v.Interface().([]string), ",")
+			}
+		case reflect.Pointer:
+			if !v.IsNil() {
+				env[field.env] = fmt.Sprint(v.Elem().Interface())
+			}
+		}
+	}
+	return env
+}
+
+// ConfigLoader applies the configuration file to the environment, where the *ConfigFromEnv functions read it.
+type ConfigLoader struct {
+	path string
+	// variables set in the environment of the process, which take precedence over the file
+	external map[string]bool
+	// variables set from the file
+	applied map[string]bool
+	// setting of each variable, to name it in errors
+	keys map[string]string
+}
+
+// NewConfigLoader returns a loader of the file at path.
+// It must be created before the file is applied to tell the variables of the process from the ones of the file.
+func NewConfigLoader(path string) *ConfigLoader {
+	l := &ConfigLoader{
+		path:     path,
+		external: make(map[string]bool),
+		applied:  make(map[string]bool),
+		keys:     make(map[string]string),
+	}
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		l.external[name] = true
+	}
+	for _, field := range configFields(reflect.ValueOf(&ConfigFile{}).Elem(), "") {
+		l.keys[field.env] = field.key
+	}
+	return l
+}
+
+// Load reads the file and sets its variables, unsetting the ones removed from it since the last load.
+// The environment is left alone if the file is invalid.
+func (l *ConfigLoader) Load() error {
+	f, err := loadConfigFile(l.path)
+	if err != nil {
+		return err
+	}
+	env := f.Env()
+	for name := range l.applied {
+		if _, ok := env[name]; !ok {
+			os.Unsetenv(name)
+			delete(l.applied, name)
+		}
+	}
+	for name, value := range env {
+		if l.external[name] {
+			continue
+		}
+		if err := os.Setenv(name, value); err != nil {
+			return err
+		}
+		l.applied[name] = true
+	}
+	return nil
+}
+
+var envName = regexp.MustCompile(`\b[A-Z][A-Z0-9]*(?:_[A-Z0-9]+)+\b`)
+
+// Explain names the settings of the file in an error about the variables set from it
+func (l *ConfigLoader) Explain(err error) error {
+	msg := envName.ReplaceAllStringFunc(err.Error(), func(name string) string {
+		if !l.applied[name] {
+			return name
+		}
+		return fmt.Sprintf("%s (%s in %s)", l.keys[name], name, l.path)
+	})
+	if msg == err.Error() {
+		return err
+	}
+	return errors.New(msg)
+}
+
+// Settings are the parts of the configuration which can be changed without a restart
+type Settings struct {
+	// API keys replacing the current ones, kept if empty
+	APIKeys              []APIKey
+	Personas             *PersonaLibrary
+	RateLimits           RateLimitConfig
+	Budget               BudgetConfig
+	Access               AccessConfig
+	Permissions          PermissionConfig
+	Moderation           ModerationConfig
+	Redaction            RedactionConfig
+	Guard                GuardConfig
+	MessageActionThreads bool
+}
+
+func settingsFromEnv() (Settings, error) {
+	var s Settings
+	var err error
+	if s.APIKeys, err = apiKeysFromEnv(); err != nil {
+		return s, err
+	}
+	if s.Personas, err = personaLibraryFromEnv(); err != nil {
+		return s, fmt.Errorf("invalid personas: %w", err)
+	}
+	if s.RateLimits, err = rateLimitConfigFromEnv(); err != nil {
+		return s, fmt.Errorf("invalid rate limit configuration: %w", err)
+	}
+	if s.Budget, err = budgetConfigFromEnv(); err != nil {
+		return s, fmt.Errorf("invalid budget configuration: %w", err)
+	}
+	if s.Access, err = accessConfigFromEnv(); err != nil {
+		return s, fmt.Errorf("invalid access configuration: %w", err)
+	}
+	if s.Permissions, err = permissionConfigFromEnv(); err != nil {
+		return s, fmt.Errorf("invalid permission configuration: %w", err)
+	}
+	if s.Moderation, err = moderationConfigFromEnv(); err != nil {
+		return s, fmt.Errorf("invalid moderation configuration: %w", err)
+	}
+	if s.Redaction, err = redactionConfigFromEnv(); err != nil {
+		return s, fmt.Errorf("invalid redaction configuration: %w", err)
+	}
+	if s.Guard, err = guardConfigFromEnv(); err != nil {
+		return s, fmt.Errorf("invalid injection guard configuration: %w", err)
+	}
+	s.MessageActionThreads = os.Getenv("MESSAGE_ACTION_REPLY") == "thread"
+	return s, nil
+}
+
+// Options returns the functional options applying the settings to a new chat bot
+func (s Settings) Options() []ChatBotOption {
+	return []ChatBotOption{
+		WithPersonas(s.Personas),
+		WithRateLimits(s.RateLimits),
+		WithBudget(s.Budget),
+		WithAccessControl(s.Access),
+		WithPermissions(s.Permissions),
+		WithModeration(s.Moderation),
+		WithRedaction(s.Redaction),
+		WithInjectionGuard(s.Guard),
+		WithMessageActionThreads(s.MessageActionThreads),
+	}
+}
+
+// Reload switches to new settings while the bot keeps running.
+// Everything is built before anything is switched, so the current settings stay in place on errors.
+// Rate limits and the budget keep their state if their configuration did not change.
+func (bot *OpenAIChatBot) Reload(s Settings) error {
+	limits := bot.limits.Load()
+	if !s.RateLimits.Enabled() {
+		limits = nil
+	} else if limits == nil || !reflect.DeepEqual(limits.config, s.RateLimits) {
+		limits = NewRateLimiter(s.RateLimits, bot.usage)
+	}
+	budget := bot.budget.Load()
+	if s.Budget.MonthlyUSD == 0 {
+		budget = nil
+	} else if budget == nil || !reflect.DeepEqual(budget.config, s.Budget) {
+		var err error
+		if budget, err = NewBudget(s.Budget); err != nil {
+			return fmt.Errorf("error loading budget state: %w", err)
+		}
+	}
+	moderation, err := bot.newModerator(s.Moderation)
+	if err != nil {
+		return fmt.Errorf("error loading moderation wordlist: %w", err)
+	}
+	var redactor *Redactor
+	if s.Redaction.Enabled() {
+		if redactor, err = NewRedactor(s.Redaction); err != nil {
+			return fmt.Errorf("invalid redaction configuration: %w", err)
+		}
+	}
+	var injections *InjectionDetector
+	if s.Guard.Action != InjectionOff {
+		if injections, err = NewInjectionDetector(s.Guard); err != nil {
+			return fmt.Errorf("invalid injection guard configuration: %w", err)
+		}
+	}
+
+	if len(s.APIKeys) > 0 && bot.keys != nil && bot.keys.SetKeys(s.APIKeys) {
+		bot.logger.Println("Updated the OpenAI API keys")
+	}
+	if s.Personas != nil {
+		bot.personas.Replace(s.Personas)
+	}
+	bot.limits.Store(limits)
+	bot.budget.Store(budget)
+	bot.access.Store(NewAccessControl(s.Access))
+	bot.permissions.Store(&s.Permissions)
+	bot.moderation.Store(moderation)
+	bot.redactor.Store(redactor)
+	bot.injections.Store(injections)
+	bot.messageActionThreads.Store(s.MessageActionThreads)
+	return nil
+}
+
+// time to wait for more changes of the configuration file before reloading it,
+// as editors often write a file in several steps
+const configDebounce = 500 * time.Millisecond
+
+// watchConfig calls reload on SIGHUP and, if path is not empty, when the file at path changes.
+// The directory of the file is watched so that files replaced by editors or Kubernetes ConfigMaps are noticed.
+// The returned function stops watching.
+func watchConfig(path string, logger Logger, reload func()) (func(), error) {
+	var watcher *fsnotify.Watcher
+	var events chan fsnotify.Event
+	var errs chan error
+	if path != "" {
+		var err error
+		if watcher, err = fsnotify.NewWatcher(); err != nil {
+			return nil, err
+		}
+		if err := watcher.Add(filepath.Dir(path)); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+		events, errs = watcher.Events, watcher.Errors
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		var debounce <-chan time.Time
+		for {
+			select {
+			case <-done:
+				return
+			case <-hup:
+				logger.Println("Received SIGHUP, reloading the configuration")
+				reload()
+			case ev := <-events:
+				// ConfigMaps swap the ..data symlink instead of writing the file
+				name := filepath.Base(ev.Name)
+				if name == filepath.Base(path) || name == "..data" {
+					debounce = time.After(configDebounce)
+				}
+			case err := <-errs:
+				logger.Println("Error watching the configuration file:", err)
+			case <-debounce:
+				debounce = nil
+				logger.Println("Configuration file changed, reloading it")
+				reload()
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(hup)
+		close(done)
+		if watcher != nil {
+			watcher.Close()
+		}
+	}, nil
+}
+
+// reloadConfig reloads the configuration file and applies the settings to the bot,
+// keeping the current configuration if anything is invalid.
+func reloadConfig(loader *ConfigLoader, bot IchatBot, logger Logger) {
+	if loader != nil {
+		if err := loader.Load(); err != nil {
+			logger.Println("Error reloading the configuration, keeping the current one:", err)
+			return
+		}
+	}
+	s, err := settingsFromEnv()
+	if err == nil {
+		err = bot.Reload(s)
+	}
+	if err != nil {
+		if loader != nil {
+			err = loader.Explain(err)
+		}
+		logger.Println("Error reloading the configuration, keeping the current one:", err)
+		return
+	}
+	logger.Println("Configuration reloaded")
+}
+
+// rotateDiscordToken reconnects to Discord if the token given by DISCORD_BOT_TOKEN or DISCORD_BOT_TOKEN_FILE changed.
+// Handlers and commands stay registered across the reconnection.
+// If the new token cannot connect, e.g. because the secret is mistyped or only partly written,
+// the bot reconnects with the previous token and the new one is tried again on the next reload.
+func rotateDiscordToken(s *discordgo.Session, logger Logger) error {
+	token, err := envSecret("DISCORD_BOT_TOKEN")
+	if err != nil || token == "" {
+		return err
+	}
+	s.RLock()
+	previous := s.Token
+	s.RUnlock()
+	if previous == "Bot "+token {
+		return nil
+	}
+	if err := s.Close(); err != nil {
+		return err
+	}
+	setDiscordToken(s, "Bot "+token)
+	if err := s.Open(); err != nil {
+		setDiscordToken(s, previous)
+		if reopenErr := s.Open(); reopenErr != nil {
+			return fmt.Errorf("cannot connect with the rotated bot token: %w, nor with the previous one: %v", err, reopenErr)
+		}
+		return fmt.Errorf("cannot connect with the rotated bot token, reconnected with the previous one: %w", err)
+	}
+	logger.Println("Reconnected to Discord with the rotated bot token")
+	return nil
+}
+
+func setDiscordToken(s *discordgo.Session, token string) {
+	s.Lock()
+	defer s.Unlock()
+	s.Token = token
+	s.Identify.Token = token
+}
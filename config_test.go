@@ -0,0 +1,266 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ewohltman/discordgo-mock/mockconstants"
+)
+
+// unsetenv unsets the variables for the test, restoring them afterwards
+func unsetenv(t *testing.T, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+}
+
+func writeConfig(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigFileEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, `
+model: gpt-test
+limits:
+  user_rpm: 0
+  exempt_roles: [mods, admins]
+budget:
+  monthly_usd: 12.5
+redaction:
+  warn: true
+`)
+	f, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"DEFAULT_MODEL":           "gpt-test",
+		"RATE_LIMIT_USER_RPM":     "0",
+		"RATE_LIMIT_EXEMPT_ROLES": "mods,admins",
+		"BUDGET_MONTHLY_USD":      "12.5",
+		"REDACTION_WARN":          "true",
+	}
+	got := f.Env()
+	if len(got) != len(want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("%s: expected %q, got %q", name, value, got[name])
+		}
+	}
+
+	writeConfig(t, path, "budget:\n  monthly_usd: 1\n  montly_limit: 2\n")
+	if _, err := loadConfigFile(path); err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("expected an unknown setting to be rejected with its line, got %v", err)
+	}
+}
+
+func TestConfigLoader(t *testing.T) {
+	unsetenv(t, "ACCESS_DMS", "ACCESS_DENY_USERS", "BUDGET_EXHAUSTED")
+	t.Setenv("ACCESS_ALLOW_GUILDS", "from-env")
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, "access:\n  allow_guilds: [from-file]\n  deny_users: [alice]\n  dms: none\n")
+	l := NewConfigLoader(path)
+	if err := l.Load(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := accessConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.AllowGuilds) != 1 || c.AllowGuilds[0] != "from-env" {
+		t.Errorf("expected the environment to take precedence, got %v", c.AllowGuilds)
+	}
+	if len(c.DenyUsers) != 1 || c.DenyUsers[0] != "alice" || c.DMs != DMNone {
+		t.Errorf("expected the settings of the file, got %+v", c)
+	}
+
+	// settings removed from the file are unset, an invalid file changes nothing
+	writeConfig(t, path, "access:\n  dms: members\n")
+	if err := l.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := os.LookupEnv("ACCESS_DENY_USERS"); ok {
+		t.Error("expected ACCESS_DENY_USERS to be unset")
+	}
+	writeConfig(t, path, "access:\n  dms: [\n")
+	if err := l.Load(); err == nil {
+		t.Error("expected an invalid file to be rejected")
+	}
+	if got := os.Getenv("ACCESS_DMS"); got != DMMembers {
+		t.Errorf("expected ACCESS_DMS to be kept, got %q", got)
+	}
+
+	// errors name the setting of the file
+	writeConfig(t, path, "budget:\n  on_exhausted: panic\n")
+	if err := l.Load(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = budgetConfigFromEnv()
+	if err == nil {
+		t.Fatal("expected an invalid budget configuration")
+	}
+	if got := l.Explain(err).Error(); !strings.Contains(got, "budget.on_exhausted (BUDGET_EXHAUSTED in "+path+")") {
+		t.Errorf("expected the setting to be named, got %q", got)
+	}
+}
+
+func TestReload(t *testing.T) {
+	fake := newFakeOpenAI(t, fakeResponse{Content: "Hi!"})
+	bot, sender := newTestOpenAIChatBot(t, fake)
+	personas, err := NewPersonaLibrary("", &Persona{Name: "pirate", SystemPrompt: "Talk like a pirate."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bot.Reload(Settings{Personas: personas}); err != nil {
+		t.Fatal(err)
+	}
+	bot.personas.SetActive(mockconstants.TestChannel, "pirate")
+
+	// an invalid configuration keeps the current one
+	invalid := Settings{
+		Access:    AccessConfig{DenyUsers: []string{mockconstants.TestUser}},
+		Redaction: RedactionConfig{Patterns: map[string]string{"broken": "("}},
+	}
+	if err := bot.Reload(invalid); err == nil {
+		t.Error("expected an invalid pattern to be rejected")
+	}
+	bot.HandleReply(newSession(), mentionMessage("hello"))
+	if len(sender.Messages[mockconstants.TestChannel]) != 1 {
+		t.Fatalf("expected a reply, got %#v", sender.Messages)
+	}
+	if got := fake.Requests()[0].Messages[0].Content; got != "Talk like a pirate." {
+		t.Errorf("expected the system prompt of the active persona, got %q", got)
+	}
+
+	personas, _ = NewPersonaLibrary("", &Persona{Name: "pirate", SystemPrompt: "Talk like a parrot."})
+	if err := bot.Reload(Settings{Personas: personas, Access: AccessConfig{DenyUsers: []string{mockconstants.TestUser}}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := bot.personas.Active(mockconstants.TestChannel).SystemPrompt; got != "Talk like a parrot." {
+		t.Errorf("expected the active persona to be kept and updated, got %q", got)
+	}
+	bot.HandleReply(newSession(), mentionMessage("hello"))
+	if len(fake.Requests()) != 1 {
+		t.Errorf("expected the user to be denied after the reload, got %d requests", len(fake.Requests()))
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, "model: a\n")
+	reloads := make(chan struct{}, 10)
+	stop, err := watchConfig(path, &MockLogger{}, func() { reloads <- struct{}{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	writeConfig(t, path, "model: b\n")
+	writeConfig(t, path, "model: c\n")
+	select {
+	case <-reloads:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a reload after the file changed")
+	}
+	select {
+	case <-reloads:
+		t.Error("expected the changes to be debounced into one reload")
+	case <-time.After(2 * configDebounce):
+	}
+}
+
+func TestEnvSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	writeConfig(t, path, "s3cret\n")
+	unsetenv(t, "TEST_SECRET", "TEST_SECRET_FILE")
+
+	t.Setenv("TEST_SECRET", "plain")
+	if got, err := envSecret("TEST_SECRET"); err != nil || got != "plain" {
+		t.Errorf("expected the variable, got %q %v", got, err)
+	}
+	t.Setenv("TEST_SECRET_FILE", path)
+	if _, err := envSecret("TEST_SECRET"); err == nil {
+		t.Error("expected setting both the variable and the file to be rejected")
+	}
+	os.Unsetenv("TEST_SECRET")
+	if got, err := envSecret("TEST_SECRET"); err != nil || got != "s3cret" {
+		t.Errorf("expected the content of the file, got %q %v", got, err)
+	}
+	t.Setenv("TEST_SECRET_FILE", path+".missing")
+	if _, err := envSecret("TEST_SECRET"); err == nil || !strings.Contains(err.Error(), "TEST_SECRET_FILE") {
+		t.Errorf("expected a missing file to be reported, got %v", err)
+	}
+}
+
+func TestReloadAPIKey(t *testing.T) {
+	fake := newFakeOpenAI(t, fakeResponse{Content: "one"}, fakeResponse{Content: "two"})
+	path := filepath.Join(t.TempDir(), "openai_api_key")
+	writeConfig(t, path, "first-key\n")
+	unsetenv(t, "OPENAI_API_KEY")
+	t.Setenv("OPENAI_API_KEY_FILE", path)
+	t.Setenv("OPENAI_BASE_URL", fake.URL+"/v1")
+	b, err := NewOpenAIChatBot(WithLogger(&MockLogger{}), WithSender(&MockSender{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot := b.(*OpenAIChatBot)
+	bot.HandleReply(newSession(), mentionMessage("hello"))
+
+	writeConfig(t, path, "second-key\n")
+	s, err := settingsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bot.Reload(s); err != nil {
+		t.Fatal(err)
+	}
+	bot.HandleReply(newSession(), mentionMessage("hello again"))
+
+	want := []string{"first-key", "second-key"}
+	if got := fake.Keys(); !slices.Equal(got, want) {
+		t.Errorf("expected keys %v, got %v", want, got)
+	}
+}
+
+func TestRotateDiscordTokenFailure(t *testing.T) {
+	s := newSession()
+	s.Token = "Bot old-token"
+	s.Identify.Token = s.Token
+	var tokens []string
+	next := s.Client.Transport
+	s.Client.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if !strings.HasSuffix(req.URL.Path, "/gateway") {
+			return next.RoundTrip(req)
+		}
+		tokens = append(tokens, req.Header.Get("Authorization"))
+		return &http.Response{StatusCode: http.StatusInternalServerError, Body: io.NopCloser(strings.NewReader("{}")), Header: http.Header{}, Request: req}, nil
+	})
+	unsetenv(t, "DISCORD_BOT_TOKEN_FILE")
+	t.Setenv("DISCORD_BOT_TOKEN", "mistyped-token")
+
+	err := rotateDiscordToken(s, &MockLogger{})
+
+	if err == nil || !strings.Contains(err.Error(), "rotated bot token") {
+		t.Errorf("expected the failed rotation to be reported, got %v", err)
+	}
+	if want := []string{"Bot mistyped-token", "Bot old-token"}; !slices.Equal(tokens, want) {
+		t.Errorf("expected to connect with %v, got %v", want, tokens)
+	}
+	if s.Token != "Bot old-token" || s.Identify.Token != "Bot old-token" {
+		t.Errorf("expected the previous token to be restored, got %q %q", s.Token, s.Identify.Token)
+	}
+}
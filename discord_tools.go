@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// maximum length of a tool result sent back to the model
+const maxToolResultLen = 4000
+
+// maximum delay of a reminder
+const maxReminderDelay = 7 * 24 * time.Hour
+
+var userIDPattern = regexp.MustCompile(`^<@!?(\d+)>$|^(\d+)$`)
+
+var messageLinkPattern = regexp.MustCompile(`https://(?:(?:ptb|canary)\.)?discord(?:app)?\.com/channels/(@me|\d+)/(\d+)/(\d+)`)
+
+// registerDiscordTools registers the tools acting within Discord.
+// Every tool checks the permissions of the invoking user since the session of the bot has broader access.
+func registerDiscordTools(r *ToolRegistry) error {
+	tools := []Tool{
+		{
+			Name:        "lookup_member",
+			Description: "Look up members of the current server by name, mention or ID and get their display names.",
+			Parameters: json.RawMessage(`{
+				"type": "object",
+				"properties": {
+					"query": {"type": "string", "description": "Beginning of the username or nickname, a mention like <@123> or a user ID"}
+				},
+				"required": ["query"]
+			}`),
+			Handler: lookupMemberTool,
+		},
+		{
+			Name:        "search_messages",
+			Description: "Search the recent messages of the current channel for a text.",
+			Parameters: json.RawMessage(`{
+				"type": "object",
+				"properties": {
+					"query": {"type": "string", "description": "Case insensitive text to search for. Empty to list the recent messages."},
+					"limit": {"type": "integer", "description": "Number of recent messages to search, at most 100. Defaults to 50."}
+				}
+			}`),
+			Handler: searchMessagesTool,
+		},
+		{
+			Name:        "fetch_message",
+			Description: "Fetch a message of the current server by its link.",
+			Parameters: json.RawMessage(`{
+				"type": "object",
+				"properties": {
+					"link": {"type": "string", "description": "Message link like https://discord.com/channels/<server>/<channel>/<message>"}
+				},
+				"required": ["link"]
+			}`),
+			Handler: fetchMessageTool,
+		},
+		{
+			Name:        "list_pins",
+			Description: "List the pinned messages of the current channel.",
+			Handler:     listPinsTool,
+		},
+		{
+			Name:        "create_poll",
+			Description: "Create a poll in the current channel.",
+			Parameters: json.RawMessage(`{
+				"type": "object",
+				"properties": {
+					"question": {"type": "string"},
+					"answers": {"type": "array", "items": {"type": "string"}, "minItems": 1, "maxItems": 10},
+					"duration_hours": {"type": "integer", "description": "How long the poll is open, 1 to 768 hours. Defaults to 24."},
+					"allow_multiselect": {"type": "boolean"}
+				},
+				"required": ["question", "answers"]
+			}`),
+			Handler: createPollTool,
+			Trusted: true,
+		},
+		{
+			Name:        "create_reminder",
+			Description: "Remind the user in the current channel after a delay. Reminders are lost when the bot restarts.",
+			Parameters: json.RawMessage(`{
+				"type": "object",
+				"properties": {
+					"message": {"type": "string", "description": "What to remind the user of"},
+					"minutes": {"type": "integer", "description": "Delay in minutes, at most 7 days"}
+				},
+				"required": ["message", "minutes"]
+			}`),
+			Handler: createReminderTool,
+			Trusted: true,
+		},
+	}
+	for _, t := range tools {
+		if err := r.Register(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// channelPermissions returns the permissions of the user in the channel.
+// In DMs the user can see and write the DM channel itself.
+func channelPermissions(s *discordgo.Session, userID, channelID string) (int64, error) {
+	ch, err := s.State.Channel(channelID)
+	if err != nil {
+		if ch, err = s.Channel(channelID); err != nil {
+			return 0, err
+		}
+	}
+	if ch.Type == discordgo.ChannelTypeDM || ch.Type == discordgo.ChannelTypeGroupDM {
+		return discordgo.PermissionViewChannel | discordgo.PermissionReadMessageHistory | discordgo.PermissionSendMessages, nil
+	}
+	return s.UserChannelPermissions(userID, channelID)
+}
+
+// requirePermissions returns an error unless the invoking user has all permissions in perm in the channel.
+func requirePermissions(tc ToolContext, channelID string, perm int64) error {
+	p, err := channelPermissions(tc.Session, tc.UserID, channelID)
+	if err != nil {
+		return fmt.Errorf("cannot check the permissions of the user: %w", err)
+	}
+	if p&discordgo.PermissionAdministrator == 0 && p&perm != perm {
+		return errors.New("the user who asked does not have permission to do this in the channel")
+	}
+	return nil
+}
+
+func lookupMemberTool(ctx context.Context, tc ToolContext, args json.RawMessage) (string, error) {
+	var p struct {
+		Query string `json:"query"`
+	}
+	if err := json.Unmarshal(args, &p); err != nil {
+		return "", err
+	}
+	if tc.GuildID == "" {
+		return "", errors.New("members can only be looked up in a server")
+	}
+	if err := requirePermissions(tc, tc.ChannelID, discordgo.PermissionViewChannel); err != nil {
+		return "", err
+	}
+
+	var members []*discordgo.Member
+	if ids := userIDPattern.FindStringSubmatch(strings.TrimSpace(p.Query)); ids != nil {
+		id := ids[1] + ids[2]
+		m, err := tc.Session.State.Member(tc.GuildID, id)
+		if err != nil {
+			m, err = tc.Session.GuildMember(tc.GuildID, id)
+		}
+		if err == nil {
+			members = append(members, m)
+		}
+	} else {
+		var err error
+		if members, err = tc.Session.GuildMembersSearch(tc.GuildID, p.Query, 10); err != nil {
+			return "", err
+		}
+	}
+	if len(members) == 0 {
+		return "no member found", nil
+	}
+	var sb strings.Builder
+	for _, m := range members {
+		fmt.Fprintf(&sb, "%s (username: %s, mention: <@%s>)\n", m.DisplayName(), m.User.Username, m.User.ID)
+	}
+	return truncate(sb.String(), maxToolResultLen), nil
+}
+
+func searchMessagesTool(ctx context.Context, tc ToolContext, args json.RawMessage) (string, error) {
+	var p struct {
+		Query string `json:"query"`
+		Limit int    `json:"limit"`
+	}
+	if err := json.Unmarshal(args, &p); err != nil {
+		return "", err
+	}
+	if p.Limit <= 0 {
+		p.Limit = 50
+	}
+	p.Limit = min(p.Limit, 100)
+	if err := requirePermissions(tc, tc.ChannelID, discordgo.PermissionViewChannel|discordgo.PermissionReadMessageHistory); err != nil {
+		return "", err
+	}
+
+	msgs, err := tc.Session.ChannelMessages(tc.ChannelID, p.Limit, "", "", "")
+	if err != nil {
+		return "", err
+	}
+	query := strings.ToLower(p.Query)
+	var sb strings.Builder
+	for _, m := range msgs {
+		if strings.Contains(strings.ToLower(m.Content), query) {
+			sb.WriteString(formatMessage(tc.GuildID, m))
+		}
+	}
+	if sb.Len() == 0 {
+		return "no message found", nil
+	}
+	return truncate(sb.String(), maxToolResultLen), nil
+}
+
+func fetchMessageTool(ctx context.Context, tc ToolContext, args json.RawMessage) (string, error) {
+	var p struct {
+		Link string `json:"link"`
+	}
+	if err := json.Unmarshal(args, &p); err != nil {
+		return "", err
+	}
+	guildID, channelID, messageID, err := parseMessageLink(p.Link)
+	if err != nil {
+		return "", err
+	}
+	// do not leak messages of other servers or DMs
+	if guildID != tc.GuildID || (guildID == "" && channelID != tc.ChannelID) {
+		return "", errors.New("only messages of the current server can be fetched")
+	}
+	if guildID != "" {
+		ch, err := tc.Session.State.Channel(channelID)
+		if err != nil {
+			ch, err = tc.Session.Channel(channelID)
+		}
+		if err != nil || ch.GuildID != guildID {
+			return "", errors.New("only messages of the current server can be fetched")
+		}
+	}
+	if err := requirePermissions(tc, channelID, discordgo.PermissionViewChannel|discordgo.PermissionReadMessageHistory); err != nil {
+		return "", err
+	}
+	m, err := tc.Session.ChannelMessage(channelID, messageID)
+	if err != nil {
+		return "", err
+	}
+	return truncate(formatMessage(guildID, m), maxToolResultLen), nil
+}
+
+func listPinsTool(ctx context.Context, tc ToolContext, args json.RawMessage) (string, error) {
+	if err := requirePermissions(tc, tc.ChannelID, discordgo.PermissionViewChannel|discordgo.PermissionReadMessageHistory); err != nil {
+		return "", err
+	}
+	msgs, err := tc.Session.ChannelMessagesPinned(tc.ChannelID)
+	if err != nil {
+		return "", err
+	}
+	if len(msgs) == 0 {
+		return "no pinned message", nil
+	}
+	var sb strings.Builder
+	for _, m := range msgs {
+		sb.WriteString(formatMessage(tc.GuildID, m))
+	}
+	return truncate(sb.String(), maxToolResultLen), nil
+}
+
+func createPollTool(ctx context.Context, tc ToolContext, args json.RawMessage) (string, error) {
+	var p struct {
+		Question         string   `json:"question"`
+		Answers          []string `json:"answers"`
+		DurationHours    int      `json:"duration_hours"`
+		AllowMultiselect bool     `json:"allow_multiselect"`
+	}
+	if err := json.Unmarshal(args, &p); err != nil {
+		return "", err
+	}
+	if p.Question == "" || len(p.Answers) == 0 || len(p.Answers) > 10 {
+		return "", errors.New("a poll needs a question and 1 to 10 answers")
+	}
+	if p.DurationHours <= 0 {
+		p.DurationHours = 24
+	}
+	p.DurationHours = min(p.DurationHours, 768)
+	if err := requirePermissions(tc, tc.ChannelID, discordgo.PermissionSendMessages|discordgo.PermissionSendPolls); err != nil {
+		return "", err
+	}
+
+	poll := &discordgo.Poll{
+		Question:         discordgo.PollMedia{Text: p.Question},
+		AllowMultiselect: p.AllowMultiselect,
+		Duration:         p.DurationHours,
+	}
+	for _, a := range p.Answers {
+		poll.Answers = append(poll.Answers, discordgo.PollAnswer{Media: &discordgo.PollMedia{Text: a}})
+	}
+	m, err := tc.Session.ChannelMessageSendComplex(tc.ChannelID, &discordgo.MessageSend{Poll: poll})
+	if err != nil {
+		return "", err
+	}
+	return "created the poll " + messageLink(tc.GuildID, m), nil
+}
+
+func createReminderTool(ctx context.Context, tc ToolContext, args json.RawMessage) (string, error) {
+	var p struct {
+		Message string `json:"message"`
+		Minutes int    `json:"minutes"`
+	}
+	if err := json.Unmarshal(args, &p); err != nil {
+		return "", err
+	}
+	delay := time.Duration(p.Minutes) * time.Minute
+	if delay <= 0 || delay > maxReminderDelay {
+		return "", errors.New("the delay must be between 1 minute and 7 days")
+	}
+	if err := requirePermissions(tc, tc.ChannelID, discordgo.PermissionSendMessages); err != nil {
+		return "", err
+	}
+
+	s, channelID, userID := tc.Session, tc.ChannelID, tc.UserID
+	time.AfterFunc(delay, func() {
+		s.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+			Content: fmt.Sprintf("<@%s> reminder: %s", userID, p.Message),
+			// only ping the user who asked
+			AllowedMentions: &discordgo.MessageAllowedMentions{Users: []string{userID}},
+		})
+	})
+	return fmt.Sprintf("the user will be reminded at %s", time.Now().Add(delay).UTC().Format(time.RFC1123)), nil
+}
+
+// parseMessageLink returns the IDs in a message link. guildID is empty for DMs.
+func parseMessageLink(link string) (guildID, channelID, messageID string, err error) {
+	m := messageLinkPattern.FindStringSubmatch(link)
+	if m == nil {
+		return "", "", "", fmt.Errorf("not a message link: %q", link)
+	}
+	if m[1] != "@me" {
+		guildID = m[1]
+	}
+	return guildID, m[2], m[3], nil
+}
+
+func messageLink(guildID string, m *discordgo.Message) string {
+	if guildID == "" {
+		guildID = "@me"
+	}
+	return fmt.Sprintf("https://discord.com/channels/%s/%s/%s", guildID, m.ChannelID, m.ID)
+}
+
+func formatMessage(guildID string, m *discordgo.Message) string {
+	author := "unknown"
+	if m.Member != nil && m.Member.Nick != "" {
+		author = m.Member.Nick
+	} else if m.Author != nil {
+		author = m.Author.DisplayName()
+	}
+	return fmt.Sprintf("[%s] %s: %s (%s)\n", m.Timestamp.UTC().Format(time.DateTime), author, m.Content, messageLink(guildID, m))
+}
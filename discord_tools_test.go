@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/ewohltman/discordgo-mock/mockconstants"
+)
+
+// newToolSession returns a session where the test channel has messages and the test role has the permissions.
+func newToolSession(t *testing.T, permissions int64) *discordgo.Session {
+	t.Helper()
+	s := newSession()
+	g, err := s.State.Guild(mockconstants.TestGuild)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Roles[0].Permissions = permissions
+	ch, err := s.State.Channel(mockconstants.TestChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch.Messages = []*discordgo.Message{
+		{ID: "1", ChannelID: ch.ID, Content: "the deploy is on Friday", Author: &discordgo.User{ID: "a", Username: "alice"}, Timestamp: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{ID: "2", ChannelID: ch.ID, Content: "lunch?", Author: &discordgo.User{ID: "b", Username: "bob"}, Timestamp: time.Date(2025, 1, 1, 0, 1, 0, 0, time.UTC)},
+	}
+	return s
+}
+
+func TestSearchMessagesTool(t *testing.T) {
+	tests := []struct {
+		name        string
+		permissions int64
+		query       string
+		expected    string
+		wantErr     bool
+	}{
+		{"Found", discordgo.PermissionViewChannel | discordgo.PermissionReadMessageHistory, "DEPLOY", "alice: the deploy is on Friday", false},
+		{"NotFound", discordgo.PermissionViewChannel | discordgo.PermissionReadMessageHistory, "release", "no message found", false},
+		{"NoHistoryPermission", discordgo.PermissionViewChannel, "deploy", "", true},
+		{"Administrator", discordgo.PermissionAdministrator, "lunch", "bob: lunch?", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tc := ToolContext{
+				Session:   newToolSession(t, test.permissions),
+				GuildID:   mockconstants.TestGuild,
+				ChannelID: mockconstants.TestChannel,
+				UserID:    mockconstants.TestUser,
+			}
+			args, _ := json.Marshal(map[string]string{"query": test.query})
+			got, err := searchMessagesTool(context.Background(), tc, args)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("searchMessagesTool returned %v, want error: %v", err, test.wantErr)
+			}
+			if !strings.Contains(got, test.expected) {
+				t.Errorf("expected %q in %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseMessageLink(t *testing.T) {
+	tests := []struct {
+		link     string
+		expected string
+		wantErr  bool
+	}{
+		{"https://discord.com/channels/1/2/3", "1/2/3", false},
+		{"see https://ptb.discord.com/channels/1/2/3 please", "1/2/3", false},
+		{"https://discord.com/channels/@me/2/3", "/2/3", false},
+		{"https://example.com/channels/1/2/3", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.link, func(t *testing.T) {
+			g, c, m, err := parseMessageLink(test.link)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseMessageLink(%q) returned %v, want error: %v", test.link, err, test.wantErr)
+			}
+			if got := strings.Join([]string{g, c, m}, "/"); !test.wantErr && got != test.expected {
+				t.Errorf("parseMessageLink(%q) = %v, want %v", test.link, got, test.expected)
+			}
+		})
+	}
+}
+
+func TestFetchMessageToolOtherGuild(t *testing.T) {
+	tc := ToolContext{
+		Session:   newToolSession(t, discordgo.PermissionAdministrator),
+		GuildID:   mockconstants.TestGuild,
+		ChannelID: mockconstants.TestChannel,
+		UserID:    mockconstants.TestUser,
+	}
+	args, _ := json.Marshal(map[string]string{"link": "https://discord.com/channels/999/" + mockconstants.TestChannel + "/1"})
+	if _, err := fetchMessageTool(context.Background(), tc, args); err == nil {
+		t.Error("expected messages of other servers to be rejected")
+	}
+}
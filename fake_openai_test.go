@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// fakeResponse scripts one answer of fakeOpenAI
+type fakeResponse struct {
+	Content      string
+	ToolCalls    []openai.ToolCall
+	FinishReason openai.FinishReason
+	Usage        openai.Usage
+	// non-zero to answer with an API error
+	Status       int
+	ErrorType    string
+	ErrorMessage string
+	// content deltas sent when the request is streamed. Content is used as a single chunk if empty.
+	Chunks []string
+	// delay before answering
+	Latency time.Duration
+}
+
+// fakeOpenAI is an httptest server implementing the parts of the OpenAI API used by the bot.
+// It answers requests with the scripted responses in order.
+type fakeOpenAI struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	responses []fakeResponse
+	requests  []openai.ChatCompletionRequest
+	// API keys of the chat completion requests
+	keys []string
+	// inputs of the moderation requests
+	moderated []string
+}
+
+func newFakeOpenAI(t *testing.T, responses ...fakeResponse) *fakeOpenAI {
+	t.Helper()
+	f := &fakeOpenAI{responses: responses}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/chat/completions", f.chatCompletions)
+	mux.HandleFunc("POST /v1/embeddings", f.embeddings)
+	mux.HandleFunc("POST /v1/moderations", f.moderations)
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+// Push appends scripted responses
+func (f *fakeOpenAI) Push(responses ...fakeResponse) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses = append(f.responses, responses...)
+}
+
+// Requests returns the chat completion requests received so far
+func (f *fakeOpenAI) Requests() []openai.ChatCompletionRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]openai.ChatCompletionRequest{}, f.requests...)
+}
+
+// Moderated returns the inputs of the moderation requests so far
+func (f *fakeOpenAI) Moderated() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.moderated...)
+}
+
+// Keys returns the API keys of the chat completion requests received so far
+func (f *fakeOpenAI) Keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.keys...)
+}
+
+// Config returns a client configuration pointing to the server
+func (f *fakeOpenAI) Config() openai.ClientConfig {
+	c := openai.DefaultConfig("test-key")
+	c.BaseURL = f.URL + "/v1"
+	return c
+}
+
+func (f *fakeOpenAI) next() (fakeResponse, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.responses) == 0 {
+		return fakeResponse{}, false
+	}
+	r := f.responses[0]
+	f.responses = f.responses[1:]
+	return r, true
+}
+
+func (f *fakeOpenAI) chatCompletions(w http.ResponseWriter, r *http.Request) {
+	var req openai.ChatCompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFakeError(w, http.StatusBadRequest, "", err.Error())
+		return
+	}
+	f.mu.Lock()
+	f.requests = append(f.requests, req)
+	f.keys = append(f.keys, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	f.mu.Unlock()
+
+	resp, ok := f.next()
+	if !ok {
+		writeFakeError(w, http.StatusInternalServerError, "", "no scripted response left")
+		return
+	}
+	select {
+	case <-time.After(resp.Latency):
+	case <-r.Context().Done():
+		return
+	}
+	if resp.Status != 0 {
+		writeFakeError(w, resp.Status, resp.ErrorType, resp.ErrorMessage)
+		return
+	}
+	finish := resp.FinishReason
+	if finish == "" && len(resp.ToolCalls) > 0 {
+		finish = openai.FinishReasonToolCalls
+	}
+	if finish == "" {
+		finish = openai.FinishReasonStop
+	}
+	if req.Stream {
+		writeFakeStream(w, req.Model, resp, finish)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(openai.ChatCompletionResponse{
+		ID:     "chatcmpl-fake",
+		Object: "chat.completion",
+		Model:  req.Model,
+		Choices: []openai.ChatCompletionChoice{
+			{
+				Message: openai.ChatCompletionMessage{
+					Role:      openai.ChatMessageRoleAssistant,
+					Content:   resp.Content,
+					ToolCalls: resp.ToolCalls,
+				},
+				FinishReason: finish,
+			},
+		},
+		Usage: resp.Usage,
+	})
+}
+
+// words counted by the fake embeddings, one dimension each
+var fakeEmbeddingVocabulary = []string{"install", "deploy", "billing", "support"}
+
+// fakeEmbedding returns a vector counting the vocabulary in the text so that texts sharing words are similar.
+func fakeEmbedding(text string) []float32 {
+	text = strings.ToLower(text)
+	v := []float32{0.01}
+	for _, w := range fakeEmbeddingVocabulary {
+		v = append(v, float32(strings.Count(text, w)))
+	}
+	return v
+}
+
+func (f *fakeOpenAI) embeddings(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Input []string `json:"input"`
+		Model string   `json:"model"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFakeError(w, http.StatusBadRequest, "", err.Error())
+		return
+	}
+	resp := openai.EmbeddingResponse{Object: "list", Model: openai.EmbeddingModel(req.Model)}
+	for n, in := range req.Input {
+		resp.Data = append(resp.Data, openai.Embedding{Object: "embedding", Index: n, Embedding: fakeEmbedding(in)})
+		resp.Usage.PromptTokens += len(strings.Fields(in))
+	}
+	resp.Usage.TotalTokens = resp.Usage.PromptTokens
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// fakeModerationScore is the score of the categories named in a moderated text
+const fakeModerationScore = 0.7
+
+// moderations scores the categories whose names appear in the input, e.g. "violence" or "self-harm"
+func (f *fakeOpenAI) moderations(w http.ResponseWriter, r *http.Request) {
+	var req openai.ModerationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFakeError(w, http.StatusBadRequest, "", err.Error())
+		return
+	}
+	f.mu.Lock()
+	f.moderated = append(f.moderated, req.Input)
+	f.mu.Unlock()
+	scores := map[string]float32{}
+	for _, category := range []string{"harassment", "hate", "self-harm", "sexual", "violence"} {
+		if strings.Contains(strings.ToLower(req.Input), category) {
+			scores[category] = fakeModerationScore
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":      "modr-fake",
+		"model":   req.Model,
+		"results": []any{map[string]any{"flagged": len(scores) > 0, "category_scores": scores}},
+	})
+}
+
+func writeFakeStream(w http.ResponseWriter, model string, resp fakeResponse, finish openai.FinishReason) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	chunks := resp.Chunks
+	if len(chunks) == 0 {
+		chunks = []string{resp.Content}
+	}
+	send := func(v openai.ChatCompletionStreamResponse) {
+		b, _ := json.Marshal(v)
+		fmt.Fprintf(w, "data: %s\n\n", b)
+		if fl, ok := w.(http.Flusher); ok {
+			fl.Flush()
+		}
+	}
+	for n, c := range chunks {
+		choice := openai.ChatCompletionStreamChoice{Delta: openai.ChatCompletionStreamChoiceDelta{Content: c}}
+		if n == 0 {
+			choice.Delta.Role = openai.ChatMessageRoleAssistant
+		}
+		if n == len(chunks)-1 {
+			choice.FinishReason = finish
+		}
+		send(openai.ChatCompletionStreamResponse{ID: "chatcmpl-fake", Object: "chat.completion.chunk", Model: model, Choices: []openai.ChatCompletionStreamChoice{choice}})
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+// writeFakeError answers with an API error of the type, fake_error if empty
+func writeFakeError(w http.ResponseWriter, status int, errType, message string) {
+	if errType == "" {
+		errType = "fake_error"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{
+			"message": message,
+			"type":    errType,
+			"code":    errType,
+		},
+	})
+}
+
+// fakeToolCall returns a tool call of the function with the arguments encoded as JSON
+func fakeToolCall(id, name string, args any) openai.ToolCall {
+	b, _ := json.Marshal(args)
+	return openai.ToolCall{
+		ID:       id,
+		Type:     openai.ToolTypeFunction,
+		Function: openai.FunctionCall{Name: name, Arguments: string(b)},
+	}
+}
+
+// newTestOpenAIChatBot returns a chat bot talking to the fake server and sending messages to a MockSender.
+func newTestOpenAIChatBot(t *testing.T, f *fakeOpenAI, opts ...ChatBotOption) (*OpenAIChatBot, *MockSender) {
+	t.Helper()
+	sender := &MockSender{}
+	opts = append([]ChatBotOption{WithClientConfig(f.Config()), WithLogger(&MockLogger{}), WithSender(sender)}, opts...)
+	bot, err := NewOpenAIChatBot(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bot.(*OpenAIChatBot), sender
+}
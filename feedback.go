@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// reactions accepted as feedback on bot replies
+const (
+	FeedbackUp   = "👍"
+	FeedbackDown = "👎"
+)
+
+// number of replies remembered for feedback
+const maxTrackedReplies = 1000
+
+// One line of the feedback log
+type FeedbackEntry struct {
+	Time      time.Time `json:"time"`
+	GuildID   string    `json:"guild_id,omitempty"`
+	ChannelID string    `json:"channel_id"`
+	MessageID string    `json:"message_id"`
+	UserID    string    `json:"user_id"`
+	Model     string    `json:"model"`
+	Prompt    string    `json:"prompt"`
+	Reply     string    `json:"reply"`
+	Rating    string    `json:"rating"`
+}
+
+// FeedbackLog remembers recent bot replies and appends the reactions to them to a JSONL file.
+type FeedbackLog struct {
+	path string
+
+	mu         sync.Mutex
+	replies    map[string]FeedbackEntry
+	order      []string
+	lastPrompt map[string]string
+}
+
+func NewFeedbackLog(path string) *FeedbackLog {
+	return &FeedbackLog{
+		path:       path,
+		replies:    make(map[string]FeedbackEntry),
+		lastPrompt: make(map[string]string),
+	}
+}
+
+// Track remembers the reply sent as msgs so that reactions to any of the messages can be recorded.
+// An empty prompt means the reply was not triggered by a new prompt (e.g. regenerate), the last prompt of the channel is used instead.
+func (f *FeedbackLog) Track(guildID, channelID, model, prompt, reply string, msgs []*discordgo.Message) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if prompt == "" {
+		prompt = f.lastPrompt[channelID]
+	} else {
+		f.lastPrompt[channelID] = prompt
+	}
+	for _, msg := range msgs {
+		if msg == nil {
+			continue
+		}
+		f.replies[msg.ID] = FeedbackEntry{
+			GuildID:   guildID,
+			ChannelID: channelID,
+			MessageID: msg.ID,
+			Model:     model,
+			Prompt:    prompt,
+			Reply:     reply,
+		}
+		f.order = append(f.order, msg.ID)
+	}
+	for len(f.order) > maxTrackedReplies {
+		delete(f.replies, f.order[0])
+		f.order = f.order[1:]
+	}
+}
+
+// Record appends the rating of the user to the log if the message is a tracked reply.
+func (f *FeedbackLog) Record(messageID, userID, rating string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entry, ok := f.replies[messageID]
+	if !ok {
+		return false, nil
+	}
+	entry.Time = time.Now().UTC()
+	entry.UserID = userID
+	entry.Rating = rating
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return true, err
+	}
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return true, err
+	}
+	defer file.Close()
+	_, err = file.Write(append(b, '\n'))
+	return true, err
+}
+
+// HandleReaction records 👍/👎 reactions on bot replies as feedback.
+func (bot *BaseChatBot) HandleReaction(s *discordgo.Session, r *discordgo.MessageReactionAdd) {
+	if bot.feedback == nil || r.UserID == s.State.User.ID {
+		return
+	}
+	var rating string
+	switch r.Emoji.Name {
+	case FeedbackUp:
+		rating = "up"
+	case FeedbackDown:
+		rating = "down"
+	default:
+		return
+	}
+	ok, err := bot.feedback.Record(r.MessageID, r.UserID, rating)
+	if err != nil {
+		bot.logger.Println("Error recording feedback:", err)
+		return
+	}
+	if ok {
+		bot.logger.Println("Recorded feedback", rating, "for message", r.MessageID)
+	}
+}
+
+func (bot *BaseChatBot) trackFeedback(guildID, channelID, prompt, reply string, msgs []*discordgo.Message) {
+	if bot.feedback == nil {
+		return
+	}
+	model := ""
+	if bot.ModelFunc != nil {
+		model = bot.ModelFunc(channelID)
+	}
+	if bot.RedactFunc != nil {
+		prompt = bot.RedactFunc(prompt)
+	}
+	bot.feedback.Track(guildID, channelID, model, prompt, reply, msgs)
+}
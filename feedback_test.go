@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/ewohltman/discordgo-mock/mockconstants"
+)
+
+func TestHandleReaction(t *testing.T) {
+	tests := []struct {
+		name      string
+		messageID string
+		userID    string
+		emoji     string
+		expected  []string
+	}{
+		{"ThumbsUp", "reply", mockconstants.TestUser, FeedbackUp, []string{"up"}},
+		{"ThumbsDown", "reply", mockconstants.TestUser, FeedbackDown, []string{"down"}},
+		{"OtherEmoji", "reply", mockconstants.TestUser, "🎉", nil},
+		{"UntrackedMessage", "other", mockconstants.TestUser, FeedbackUp, nil},
+		{"BotItself", "reply", "123", FeedbackUp, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "feedback.jsonl")
+			chatbot := BaseChatBot{
+				logger:    &MockLogger{},
+				sender:    &MockSender{},
+				feedback:  NewFeedbackLog(path),
+				ModelFunc: func(string) string { return "test-model" },
+			}
+			chatbot.trackFeedback(mockconstants.TestGuild, mockconstants.TestChannel, "prompt", "reply", []*discordgo.Message{{ID: "reply"}})
+
+			chatbot.HandleReaction(newSession(), &discordgo.MessageReactionAdd{
+				MessageReaction: &discordgo.MessageReaction{
+					UserID:    test.userID,
+					MessageID: test.messageID,
+					ChannelID: mockconstants.TestChannel,
+					Emoji:     discordgo.Emoji{Name: test.emoji},
+				},
+			})
+
+			var ratings []string
+			f, err := os.Open(path)
+			if err == nil {
+				defer f.Close()
+				scanner := bufio.NewScanner(f)
+				for scanner.Scan() {
+					var entry FeedbackEntry
+					if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+						t.Fatal(err)
+					}
+					if entry.Prompt != "prompt" || entry.Reply != "reply" || entry.Model != "test-model" {
+						t.Errorf("unexpected entry %#v", entry)
+					}
+					ratings = append(ratings, entry.Rating)
+				}
+			}
+			if len(ratings) != len(test.expected) {
+				t.Fatalf("expected ratings %v, got %v", test.expected, ratings)
+			}
+			for n := range ratings {
+				if ratings[n] != test.expected[n] {
+					t.Errorf("expected ratings %v, got %v", test.expected, ratings)
+				}
+			}
+		})
+	}
+}
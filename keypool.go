@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// time a key is not used after it was rate limited unless the response says otherwise
+const keyBenchTime = time.Minute
+
+// APIKey is an OpenAI API key with the organization and project its requests are billed to
+type APIKey struct {
+	Key          string
+	Organization string
+	Project      string
+}
+
+// String returns the end of the key, which is enough to tell keys apart in logs
+func (k APIKey) String() string {
+	if len(k.Key) <= 8 {
+		return "…"
+	}
+	return "…" + k.Key[len(k.Key)-4:]
+}
+
+// parseAPIKeys parses keys separated by commas or newlines.
+// Each key may be followed by its organization and project as key:organization:project.
+// Empty lines and lines starting with # are skipped.
+func parseAPIKeys(v string) []APIKey {
+	var keys []APIKey
+	for _, line := range strings.Split(v, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		for _, entry := range strings.Split(line, ",") {
+			parts := strings.SplitN(strings.TrimSpace(entry), ":", 3)
+			if parts[0] == "" {
+				continue
+			}
+			k := APIKey{Key: parts[0]}
+			if len(parts) > 1 {
+				k.Organization = parts[1]
+			}
+			if len(parts) > 2 {
+				k.Project = parts[2]
+			}
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// apiKeysFromEnv returns the keys given by OPENAI_API_KEY or the file of OPENAI_API_KEY_FILE.
+func apiKeysFromEnv() ([]APIKey, error) {
+	v, err := envSecret("OPENAI_API_KEY")
+	if err != nil {
+		return nil, err
+	}
+	return parseAPIKeys(v), nil
+}
+
+type pooledKey struct {
+	APIKey
+	// the key is not used before this time after it was rate limited
+	benchedUntil time.Time
+	// the key was rejected and is not used anymore
+	disabled bool
+}
+
+// KeyPool spreads the requests of a client across API keys in turn.
+// A key is benched for a while when it is rate limited and disabled when it is rejected or out of quota,
+// and the request is retried with the next key.
+type KeyPool struct {
+	next   openai.HTTPDoer
+	logger Logger
+	now    func() time.Time
+
+	mu   sync.Mutex
+	keys []*pooledKey
+	// index of the key to try first for the next request
+	turn int
+}
+
+// NewKeyPool returns a pool of the keys sending requests with next
+func NewKeyPool(keys []APIKey, next openai.HTTPDoer, logger Logger) *KeyPool {
+	p := &KeyPool{next: next, logger: logger, now: time.Now}
+	p.SetKeys(keys)
+	return p
+}
+
+// SetKeys replaces the keys of the pool and reports whether they changed.
+// Keys which stay in the pool keep being benched or disabled.
+func (p *KeyPool) SetKeys(keys []APIKey) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old := make(map[APIKey]*pooledKey)
+	for _, k := range p.keys {
+		old[k.APIKey] = k
+	}
+	changed := len(keys) != len(p.keys)
+	pooled := make([]*pooledKey, 0, len(keys))
+	for n, k := range keys {
+		if prev, ok := old[k]; ok {
+			pooled = append(pooled, prev)
+		} else {
+			pooled = append(pooled, &pooledKey{APIKey: k})
+		}
+		changed = changed || p.keys[n].APIKey != k
+	}
+	p.keys = pooled
+	p.turn = 0
+	return changed
+}
+
+// pick returns the next key which is neither benched, disabled nor already tried for the request
+func (p *KeyPool) pick(tried map[*pooledKey]bool) (*pooledKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	var wait time.Duration
+	for n := range p.keys {
+		k := p.keys[(p.turn+n)%len(p.keys)]
+		if k.disabled || tried[k] {
+			continue
+		}
+		if d := k.benchedUntil.Sub(now); d > 0 {
+			if wait == 0 || d < wait {
+				wait = d
+			}
+			continue
+		}
+		p.turn = (p.turn + n + 1) % len(p.keys)
+		return k, nil
+	}
+	if len(tried) > 0 {
+		return nil, nil
+	}
+	if wait > 0 {
+		return nil, &userFacingError{fmt.Sprintf("All API keys are rate limited. Please try again in %d seconds.", int(wait.Seconds()+1))}
+	}
+	return nil, &userFacingError{"No OpenAI API key is working. Please ask the owner of the bot to check the keys."}
+}
+
+// Do sends the request with the next key, retrying with the other keys while it is rate limited or rejected.
+func (p *KeyPool) Do(req *http.Request) (*http.Response, error) {
+	tried := make(map[*pooledKey]bool)
+	var last *http.Response
+	for {
+		k, err := p.pick(tried)
+		if err != nil {
+			return nil, err
+		}
+		if k == nil {
+			return last, nil
+		}
+		if last != nil {
+			last.Body.Close()
+			if req.GetBody == nil {
+				return nil, fmt.Errorf("cannot retry the request with another key")
+			}
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		tried[k] = true
+		req.Header.Set("Authorization", "Bearer "+k.Key)
+		setHeader(req.Header, "OpenAI-Organization", k.Organization)
+		setHeader(req.Header, "OpenAI-Project", k.Project)
+		resp, err := p.next.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests && insufficientQuota(resp):
+			p.disable(k, "has no quota left")
+		case resp.StatusCode == http.StatusTooManyRequests:
+			p.bench(k, retryAfter(resp.Header))
+		case resp.StatusCode == http.StatusUnauthorized:
+			p.disable(k, "was rejected")
+		default:
+			return resp, nil
+		}
+		last = resp
+	}
+}
+
+func (p *KeyPool) bench(k *pooledKey, d time.Duration) {
+	p.mu.Lock()
+	k.benchedUntil = p.now().Add(d)
+	p.mu.Unlock()
+	p.logger.Println("API key", k, "is rate limited, not using it for", d)
+}
+
+func (p *KeyPool) disable(k *pooledKey, reason string) {
+	p.mu.Lock()
+	k.disabled = true
+	p.mu.Unlock()
+	p.logger.Println("API key", k, reason+", not using it anymore")
+}
+
+// insufficientQuota reports whether a 429 response means that the billing of the key is exhausted rather than rate limited.
+// The body stays readable for the client.
+func insufficientQuota(resp *http.Response) bool {
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	var e openai.ErrorResponse
+	if json.Unmarshal(body, &e) != nil || e.Error == nil {
+		return false
+	}
+	return e.Error.Type == "insufficient_quota" || e.Error.Code == "insufficient_quota"
+}
+
+// setHeader sets the header, or removes it if value is empty
+func setHeader(h http.Header, name, value string) {
+	if value == "" {
+		h.Del(name)
+		return
+	}
+	h.Set(name, value)
+}
+
+// retryAfter returns the time to wait given by the Retry-After header in seconds, or keyBenchTime
+func retryAfter(h http.Header) time.Duration {
+	if s, err := strconv.Atoi(h.Get("Retry-After")); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	return keyBenchTime
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ewohltman/discordgo-mock/mockconstants"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestParseAPIKeys(t *testing.T) {
+	got := parseAPIKeys("sk-a, sk-b:org-1\n# retired\n#sk-old\nsk-c:org-2:proj-3\n\n")
+	want := []APIKey{{Key: "sk-a"}, {Key: "sk-b", Organization: "org-1"}, {Key: "sk-c", Organization: "org-2", Project: "proj-3"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+// newTestKeyPool returns a pool of the keys sending requests to the fake server and a client using it
+func newTestKeyPool(f *fakeOpenAI, keys ...string) (*KeyPool, openai.ClientConfig) {
+	config := f.Config()
+	var apiKeys []APIKey
+	for _, k := range keys {
+		apiKeys = append(apiKeys, APIKey{Key: k})
+	}
+	pool := NewKeyPool(apiKeys, config.HTTPClient, &MockLogger{})
+	config.HTTPClient = pool
+	return pool, config
+}
+
+func TestKeyPool(t *testing.T) {
+	fake := newFakeOpenAI(t)
+	pool, config := newTestKeyPool(fake, "a", "b", "c")
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+	client := openai.NewClientWithConfig(config)
+	ok := fakeResponse{Content: "ok"}
+
+	steps := []struct {
+		name      string
+		responses []fakeResponse
+		requests  int
+		advance   time.Duration
+	}{
+		{"RoundRobin", []fakeResponse{ok, ok, ok}, 3, 0},
+		// retried with the next key
+		{"RateLimited", []fakeResponse{{Status: http.StatusTooManyRequests, ErrorMessage: "slow down"}, ok}, 1, 0},
+		{"Rejected", []fakeResponse{{Status: http.StatusUnauthorized, ErrorMessage: "invalid key"}, ok}, 1, 0},
+		{"RemainingKey", []fakeResponse{ok, ok}, 2, 0},
+		{"BenchOver", []fakeResponse{ok}, 1, keyBenchTime},
+	}
+	for _, step := range steps {
+		now = now.Add(step.advance)
+		fake.Push(step.responses...)
+		for range step.requests {
+			_, err := client.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{Model: "m"})
+			if err != nil {
+				t.Fatalf("%s: %v", step.name, err)
+			}
+		}
+	}
+	want := []string{"a", "b", "c", "a", "b", "c", "b", "b", "b", "a"}
+	if got := fake.Keys(); !slices.Equal(got, want) {
+		t.Errorf("expected keys %v, got %v", want, got)
+	}
+
+	// keys staying in the pool keep their state
+	if pool.SetKeys([]APIKey{{Key: "a"}, {Key: "b"}, {Key: "c"}}) {
+		t.Error("expected the keys to be unchanged")
+	}
+	if !pool.keys[2].disabled {
+		t.Error("expected the rejected key to stay disabled")
+	}
+	if !pool.SetKeys([]APIKey{{Key: "b"}, {Key: "d"}}) {
+		t.Error("expected the keys to be changed")
+	}
+}
+
+func TestKeyPoolInsufficientQuota(t *testing.T) {
+	fake := newFakeOpenAI(t,
+		fakeResponse{Status: http.StatusTooManyRequests, ErrorType: "insufficient_quota", ErrorMessage: "You exceeded your current quota"},
+		fakeResponse{Content: "ok"}, fakeResponse{Content: "ok"}, fakeResponse{Content: "ok"},
+	)
+	pool, config := newTestKeyPool(fake, "a", "b")
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+	client := openai.NewClientWithConfig(config)
+
+	for n := range 3 {
+		// a rate limited key would be used again after the bench time
+		now = now.Add(keyBenchTime)
+		if _, err := client.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{Model: "m"}); err != nil {
+			t.Fatalf("request %d: %v", n, err)
+		}
+	}
+	if want := []string{"a", "b", "b", "b"}; !slices.Equal(fake.Keys(), want) {
+		t.Errorf("expected keys %v, got %v", want, fake.Keys())
+	}
+	if !pool.keys[0].disabled {
+		t.Error("expected the key without quota to be disabled")
+	}
+}
+
+func TestKeyPoolExhausted(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		first  string
+		second string
+	}{
+		{"Rejected", http.StatusUnauthorized, "The OpenAI API key was rejected. Please ask the owner of the bot to check the keys.",
+			"No OpenAI API key is working. Please ask the owner of the bot to check the keys."},
+		{"RateLimited", http.StatusTooManyRequests, "slow down",
+			"All API keys are rate limited. Please try again in 60 seconds."},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeOpenAI(t, fakeResponse{Status: test.status, ErrorMessage: "slow down"})
+			_, config := newTestKeyPool(fake, "only")
+			logger := &MockLogger{}
+			bot, sender := newTestOpenAIChatBot(t, fake, WithClientConfig(config), WithLogger(logger))
+
+			bot.HandleReply(newSession(), mentionMessage("hello"))
+			bot.HandleReply(newSession(), mentionMessage("hello again"))
+
+			want := []string{test.first, test.second}
+			got := sender.Messages[mockconstants.TestChannel]
+			if len(got) != 2 || strings.TrimSpace(got[0]) != want[0] || strings.TrimSpace(got[1]) != want[1] {
+				t.Errorf("expected messages %#v, got %#v", want, got)
+			}
+			if len(fake.Requests()) != 1 {
+				t.Errorf("expected the exhausted pool not to send requests, got %d", len(fake.Requests()))
+			}
+			if len(logger.GetFatalLogs()) > 0 {
+				t.Errorf("expected the bot to keep running, got %v", logger.GetFatalLogs())
+			}
+		})
+	}
+}
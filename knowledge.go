@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// how long the messages of a knowledge channel are cached, so that edits and deletions are picked up eventually
+const knowledgeChannelTTL = 10 * time.Minute
+
+// number of recent messages of a knowledge channel used as reference
+const knowledgeChannelMessages = 100
+
+type KnowledgeConfig struct {
+	// use the pinned messages of the channel as reference material
+	Pins bool
+	// channels whose messages are reference material for every channel of their server
+	Channels []string
+	// maximum length of the reference material added to the system prompt
+	MaxChars int
+}
+
+func knowledgeConfigFromEnv() (KnowledgeConfig, error) {
+	c := KnowledgeConfig{
+		Pins:     os.Getenv("KNOWLEDGE_PINS") == "true",
+		Channels: envList("KNOWLEDGE_CHANNELS"),
+	}
+	var err error
+	c.MaxChars, err = envInt("KNOWLEDGE_MAX_CHARS", 6000)
+	return c, err
+}
+
+func (c KnowledgeConfig) Enabled() bool {
+	return c.Pins || len(c.Channels) > 0
+}
+
+type knowledgeEntry struct {
+	guildID string
+	text    string
+	fetched time.Time
+}
+
+// KnowledgeBase caches the pinned messages and knowledge channels used as reference material.
+type KnowledgeBase struct {
+	config KnowledgeConfig
+	logger Logger
+
+	mu    sync.Mutex
+	pins  map[string]knowledgeEntry
+	notes map[string]knowledgeEntry
+}
+
+func NewKnowledgeBase(c KnowledgeConfig, logger Logger) *KnowledgeBase {
+	return &KnowledgeBase{
+		config: c,
+		logger: logger,
+		pins:   make(map[string]knowledgeEntry),
+		notes:  make(map[string]knowledgeEntry),
+	}
+}
+
+// Invalidate drops the cached messages of the channel
+func (kb *KnowledgeBase) Invalidate(channelID string) {
+	kb.mu.Lock()
+	defer kb.mu.Unlock()
+	delete(kb.pins, channelID)
+	delete(kb.notes, channelID)
+}
+
+// Reference returns the reference material for a request in the channel, fetching it if not cached.
+func (kb *KnowledgeBase) Reference(s *discordgo.Session, guildID, channelID string) string {
+	var sb strings.Builder
+	if kb.config.Pins {
+		if e, err := kb.pinned(s, channelID); err != nil {
+			kb.logger.Println("Error fetching pinned messages:", err)
+		} else if e.text != "" {
+			sb.WriteString("Pinned messages of this channel:\n" + e.text)
+		}
+	}
+	for _, id := range kb.config.Channels {
+		e, err := kb.knowledgeChannel(s, id)
+		if err != nil {
+			kb.logger.Println("Error fetching knowledge channel:", err)
+			continue
+		}
+		// knowledge channels only apply to their own server
+		if e.text == "" || guildID == "" || e.guildID != guildID {
+			continue
+		}
+		fmt.Fprintf(&sb, "Notes from <#%s>:\n%s", id, e.text)
+	}
+	return truncate(sb.String(), kb.config.MaxChars)
+}
+
+func (kb *KnowledgeBase) pinned(s *discordgo.Session, channelID string) (knowledgeEntry, error) {
+	kb.mu.Lock()
+	e, ok := kb.pins[channelID]
+	kb.mu.Unlock()
+	if ok {
+		return e, nil
+	}
+	msgs, err := s.ChannelMessagesPinned(channelID)
+	if err != nil {
+		return e, err
+	}
+	e = knowledgeEntry{text: formatKnowledge(msgs), fetched: time.Now()}
+	kb.mu.Lock()
+	kb.pins[channelID] = e
+	kb.mu.Unlock()
+	return e, nil
+}
+
+func (kb *KnowledgeBase) knowledgeChannel(s *discordgo.Session, channelID string) (knowledgeEntry, error) {
+	kb.mu.Lock()
+	e, ok := kb.notes[channelID]
+	kb.mu.Unlock()
+	if ok && time.Since(e.fetched) < knowledgeChannelTTL {
+		return e, nil
+	}
+	ch, err := s.State.Channel(channelID)
+	if err != nil {
+		if ch, err = s.Channel(channelID); err != nil {
+			return e, err
+		}
+	}
+	msgs, err := s.ChannelMessages(channelID, knowledgeChannelMessages, "", "", "")
+	if err != nil {
+		return e, err
+	}
+	// messages are returned newest first
+	slices.Reverse(msgs)
+	e = knowledgeEntry{guildID: ch.GuildID, text: formatKnowledge(msgs), fetched: time.Now()}
+	kb.mu.Lock()
+	kb.notes[channelID] = e
+	kb.mu.Unlock()
+	return e, nil
+}
+
+func formatKnowledge(msgs []*discordgo.Message) string {
+	var sb strings.Builder
+	for _, m := range msgs {
+		if strings.TrimSpace(m.Content) == "" {
+			continue
+		}
+		sb.WriteString("- " + strings.ReplaceAll(strings.TrimSpace(m.Content), "\n", "\n  ") + "\n")
+	}
+	return sb.String()
+}
+
+// HandlePinsUpdate refreshes the pinned messages of the channel.
+func (bot *OpenAIChatBot) HandlePinsUpdate(s *discordgo.Session, p *discordgo.ChannelPinsUpdate) {
+	if bot.knowledge == nil {
+		return
+	}
+	bot.knowledge.Invalidate(p.ChannelID)
+	bot.logger.Println("Pinned messages of channel", p.ChannelID, "changed")
+}
+
+// HandleKnowledgeMessage refreshes a knowledge channel when a message is posted to it.
+func (bot *OpenAIChatBot) HandleKnowledgeMessage(s *discordgo.Session, m *discordgo.MessageCreate) {
+	if bot.knowledge == nil || !slices.Contains(bot.knowledge.config.Channels, m.ChannelID) {
+		return
+	}
+	bot.knowledge.Invalidate(m.ChannelID)
+}
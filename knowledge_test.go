@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/ewohltman/discordgo-mock/mockconstants"
+)
+
+func TestKnowledgeChannel(t *testing.T) {
+	s := newSession()
+	ch, err := s.State.Channel(mockconstants.TestChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// newest first like the API
+	ch.Messages = []*discordgo.Message{
+		{ID: "2", ChannelID: ch.ID, Content: "The office closes at 6pm."},
+		{ID: "1", ChannelID: ch.ID, Content: "Standup is at 10am."},
+	}
+	fake := newFakeOpenAI(t)
+	bot, _ := newTestOpenAIChatBot(t, fake, WithKnowledge(KnowledgeConfig{Channels: []string{mockconstants.TestChannel}, MaxChars: 1000}))
+	systemPrompt := func(guildID string) string {
+		prompt, err := bot.systemPrompt(bot.personas.Active("other"), requestMeta{Session: s, GuildID: guildID, ChannelID: "other"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return prompt
+	}
+
+	prompt := systemPrompt(mockconstants.TestGuild)
+	if !strings.Contains(prompt, "- Standup is at 10am.\n- The office closes at 6pm.") {
+		t.Errorf("expected the notes in chronological order, got %q", prompt)
+	}
+	if prompt := systemPrompt("other guild"); prompt != defaultSystemPrompt {
+		t.Errorf("expected no notes of another server, got %q", prompt)
+	}
+
+	ch.Messages = append([]*discordgo.Message{{ID: "3", ChannelID: ch.ID, Content: "Standup moved to 11am."}}, ch.Messages...)
+	bot.HandleKnowledgeMessage(s, &discordgo.MessageCreate{Message: ch.Messages[0]})
+	prompt = systemPrompt(mockconstants.TestGuild)
+	if !strings.Contains(prompt, "Standup moved to 11am.") {
+		t.Errorf("expected the notes to be refreshed, got %q", prompt)
+	}
+}
+
+func TestPinnedMessages(t *testing.T) {
+	s := newSession()
+	pins := []*discordgo.Message{{ID: "1", ChannelID: mockconstants.TestChannel, Content: "Be nice."}}
+	fetches := 0
+	next := s.Client.Transport
+	s.Client.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Method != http.MethodGet || !strings.HasSuffix(req.URL.Path, "/pins") {
+			return next.RoundTrip(req)
+		}
+		fetches++
+		b, _ := json.Marshal(pins)
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(string(b))), Header: http.Header{}, Request: req}, nil
+	})
+	fake := newFakeOpenAI(t, fakeResponse{Content: "one"}, fakeResponse{Content: "two"}, fakeResponse{Content: "three"})
+	bot, _ := newTestOpenAIChatBot(t, fake, WithKnowledge(KnowledgeConfig{Pins: true, MaxChars: 1000}))
+
+	bot.HandleReply(s, mentionMessage("hello"))
+	bot.HandleReply(s, mentionMessage("again"))
+	pins = append(pins, &discordgo.Message{ID: "2", ChannelID: mockconstants.TestChannel, Content: "No spoilers."})
+	bot.HandlePinsUpdate(s, &discordgo.ChannelPinsUpdate{ChannelID: mockconstants.TestChannel})
+	bot.HandleReply(s, mentionMessage("and now?"))
+
+	if fetches != 2 {
+		t.Errorf("expected the pins to be fetched again only after they changed, got %d fetches", fetches)
+	}
+	reqs := fake.Requests()
+	if len(reqs) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(reqs))
+	}
+	for n, want := range []string{"- Be nice.\n", "- Be nice.\n", "- Be nice.\n- No spoilers.\n"} {
+		if got := reqs[n].Messages[0].Content; !strings.Contains(got, "Pinned messages of this channel:\n"+want) {
+			t.Errorf("request %d: expected the pins %q in the system prompt, got %q", n, want, got)
+		}
+	}
+	if strings.Contains(reqs[1].Messages[0].Content, "No spoilers.") {
+		t.Errorf("expected the cached pins before the update, got %q", reqs[1].Messages[0].Content)
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"os"
 	"os/signal"
@@ -19,6 +22,23 @@ var commands = []*discordgo.ApplicationCommand{
 		Name:        "forget",
 		Description: "forget chat context of this channel",
 	},
+	{
+		Name:        "ask",
+		Description: "ask a single question without the conversation of this channel",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "question",
+				Description: "question to ask",
+				Required:    true,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionBoolean,
+				Name:        "private",
+				Description: "only show the answer to you",
+			},
+		},
+	},
 }
 
 func main() {
@@ -27,14 +47,102 @@ func main() {
 		log.Println("Error loading .env file, using env variable")
 	}
 
-	gpt, err := NewOpenAIChatBot()
+	if len(os.Args) > 1 && os.Args[1] == "ingest" {
+		if err := runIngest(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal("Error ingesting documents: ", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		err := runReplay(os.Args[2:], os.Stdout)
+		if errors.Is(err, errReplayMismatch) {
+			os.Exit(1)
+		}
+		if err != nil {
+			log.Fatal("Error replaying audit log: ", err)
+		}
+		return
+	}
+
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path of the YAML configuration file")
+	flag.Parse()
+	var config *ConfigLoader
+	if *configPath != "" {
+		config = NewConfigLoader(*configPath)
+		if err := config.Load(); err != nil {
+			log.Fatal("Invalid configuration file: ", err)
+		}
+	}
+	explain := func(err error) error {
+		if config == nil {
+			return err
+		}
+		return config.Explain(err)
+	}
+
+	auditConfig, err := auditConfigFromEnv()
+	if err != nil {
+		log.Fatal("Invalid audit log configuration: ", explain(err))
+	}
+	toolConfig, err := toolConfigFromEnv()
+	if err != nil {
+		log.Fatal("Invalid tool configuration: ", explain(err))
+	}
+	tools := NewToolRegistry()
+	if err := registerDefaultTools(tools); err != nil {
+		log.Fatal("Error registering tools: ", err)
+	}
+	if err := registerDiscordTools(tools); err != nil {
+		log.Fatal("Error registering Discord tools: ", err)
+	}
+	if path := os.Getenv("MCP_CONFIG"); path != "" {
+		mcpConfig, err := loadMCPConfig(path)
+		if err != nil {
+			log.Fatal("Invalid MCP configuration: ", err)
+		}
+		for _, c := range connectMCPServers(context.Background(), mcpConfig, tools, &DefaultLogger{}) {
+			defer c.Close()
+		}
+	}
+	ragConfig, err := ragConfigFromEnv()
+	if err != nil {
+		log.Fatal("Invalid RAG configuration: ", explain(err))
+	}
+	knowledgeConfig, err := knowledgeConfigFromEnv()
+	if err != nil {
+		log.Fatal("Invalid knowledge configuration: ", explain(err))
+	}
+	usageConfig, err := usageConfigFromEnv()
+	if err != nil {
+		log.Fatal("Invalid usage configuration: ", explain(err))
+	}
+	settings, err := settingsFromEnv()
+	if err != nil {
+		log.Fatal(explain(err))
+	}
+	// the command choices and default permissions are registered once, changes of them need a restart
+	commands = append(commands, personaCommand(settings.Personas))
+	commands = append(commands, summarizeCommand, usageCommand)
+	commands = append(commands, messageActionCommands()...)
+	settings.Permissions.SetDefaultPermissions(commands)
+	gpt, err := NewOpenAIChatBot(append([]ChatBotOption{
+		WithFeedbackLog(os.Getenv("FEEDBACK_LOG")),
+		WithAuditLog(auditConfig),
+		WithTools(tools, toolConfig),
+		WithRAG(ragConfig),
+		WithKnowledge(knowledgeConfig),
+		WithUsage(usageConfig),
+	}, settings.Options()...)...)
 	if err != nil {
 		log.Fatal("Error creating chat bot: ", err)
 	}
 
-	botToken := os.Getenv("DISCORD_BOT_TOKEN")
+	botToken, err := envSecret("DISCORD_BOT_TOKEN")
+	if err != nil {
+		log.Fatal(err)
+	}
 	if botToken == "" {
-		log.Fatal("DISCORD_BOT_TOKEN not found in .env file")
+		log.Fatal("DISCORD_BOT_TOKEN not found in .env file or DISCORD_BOT_TOKEN_FILE")
 	}
 	// Create a new Discord session using the provided bot token.
 	dg, err := discordgo.New("Bot " + botToken)
@@ -44,8 +152,15 @@ func main() {
 
 	// Register the messageCreate func as a callback for MessageCreate events.
 	dg.AddHandler(gpt.HandleReply)
-	// In this example, we only care about receiving message events.
-	dg.Identify.Intents = discordgo.IntentsGuildMessages | discordgo.IntentsDirectMessages
+	// Reactions on replies are recorded as feedback
+	dg.AddHandler(gpt.HandleReaction)
+	// Pinned messages and knowledge channels are reference material
+	dg.AddHandler(gpt.HandlePinsUpdate)
+	dg.AddHandler(gpt.HandleKnowledgeMessage)
+	// Leave guilds the bot may not be used in
+	dg.AddHandler(gpt.HandleGuildCreate)
+	dg.Identify.Intents = discordgo.IntentsGuilds | discordgo.IntentsGuildMessages | discordgo.IntentsDirectMessages |
+		discordgo.IntentsGuildMessageReactions | discordgo.IntentsDirectMessageReactions
 
 	// Open a websocket connection to Discord and begin listening.
 	err = dg.Open()
@@ -56,12 +171,34 @@ func main() {
 
 	// Register commands
 	commandHandlers := map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate){
-		"forget": gpt.RemoveContext,
+		"forget":    gpt.RemoveContext,
+		"persona":   gpt.SetPersona,
+		"ask":       gpt.Ask,
+		"summarize": gpt.Summarize,
+		"usage":     gpt.ShowUsage,
+	}
+	// Handlers for the buttons attached to bot replies
+	componentHandlers := map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate){
+		ComponentRegenerate: gpt.Regenerate,
+		ComponentContinue:   gpt.Continue,
+		ComponentForget:     gpt.RemoveContext,
 	}
 
 	dg.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
-		if h, ok := commandHandlers[i.ApplicationCommandData().Name]; ok {
-			h(s, i)
+		if !gpt.AllowInteraction(s, i) {
+			return
+		}
+		switch i.Type {
+		case discordgo.InteractionApplicationCommand:
+			if i.ApplicationCommandData().CommandType == discordgo.MessageApplicationCommand {
+				gpt.HandleMessageAction(s, i)
+			} else if h, ok := commandHandlers[i.ApplicationCommandData().Name]; ok {
+				h(s, i)
+			}
+		case discordgo.InteractionMessageComponent:
+			if h, ok := componentHandlers[i.MessageComponentData().CustomID]; ok {
+				h(s, i)
+			}
 		}
 	})
 	registeredCommands := make([]*discordgo.ApplicationCommand, len(commands))
@@ -75,6 +212,19 @@ func main() {
 		registeredCommands[i] = cmd
 	}
 
+	// Reload the configuration on SIGHUP and changes of the file without reconnecting,
+	// unless the bot token was rotated
+	stopWatching, err := watchConfig(*configPath, &DefaultLogger{}, func() {
+		reloadConfig(config, gpt, &DefaultLogger{})
+		if err := rotateDiscordToken(dg, &DefaultLogger{}); err != nil {
+			log.Println("Error rotating the Discord bot token:", err)
+		}
+	})
+	if err != nil {
+		log.Fatal("Error watching the configuration file: ", err)
+	}
+	defer stopWatching()
+
 	// Wait here until CTRL-C or other term signal is received.
 	log.Println("Bot is now running.  Press CTRL-C to exit.")
 	sc := make(chan os.Signal, 1)
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MCP protocol version requested on initialization
+const mcpProtocolVersion = "2025-06-18"
+
+// timeout of the initialization of an MCP server
+const mcpInitTimeout = 30 * time.Second
+
+// MCPServerConfig describes how to reach an MCP server. Either Command or URL has to be set.
+type MCPServerConfig struct {
+	// stdio transport: subprocess speaking newline-delimited JSON-RPC
+	Command string            `json:"command,omitempty"`
+	Args    []string          `json:"args,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	// streamable HTTP transport
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// MCPConfig is the format of the file at MCP_CONFIG, compatible with the common mcp.json layout.
+type MCPConfig struct {
+	Servers map[string]MCPServerConfig `json:"mcpServers"`
+}
+
+func loadMCPConfig(path string) (MCPConfig, error) {
+	var c MCPConfig
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, fmt.Errorf("%s: %w", path, err)
+	}
+	for name, s := range c.Servers {
+		if (s.Command == "") == (s.URL == "") {
+			return c, fmt.Errorf("%s: MCP server %q needs either a command or a url", path, name)
+		}
+	}
+	return c, nil
+}
+
+type jsonrpcMessage struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *int64           `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  any              `json:"params,omitempty"`
+	Result  json.RawMessage  `json:"result,omitempty"`
+	Error   *jsonrpcErrorObj `json:"error,omitempty"`
+}
+
+type jsonrpcErrorObj struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *jsonrpcErrorObj) Error() string {
+	return fmt.Sprintf("MCP error %d: %s", e.Code, e.Message)
+}
+
+// mcpTransport sends JSON-RPC messages to an MCP server.
+type mcpTransport interface {
+	// Call sends the request and waits for the response with the same ID
+	Call(ctx context.Context, req jsonrpcMessage) (jsonrpcMessage, error)
+	// Notify sends a message without waiting for a response
+	Notify(ctx context.Context, msg jsonrpcMessage) error
+	Close() error
+}
+
+// stdioTransport talks to a subprocess over its stdin and stdout.
+type stdioTransport struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	pending map[int64]chan jsonrpcMessage
+	done    chan struct{}
+	err     error
+}
+
+func newStdioTransport(c MCPServerConfig, logger Logger) (*stdioTransport, error) {
+	cmd := exec.Command(c.Command, c.Args...)
+	cmd.Env = os.Environ()
+	for k, v := range c.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	t := &stdioTransport{
+		cmd:     cmd,
+		stdin:   stdin,
+		pending: make(map[int64]chan jsonrpcMessage),
+		done:    make(chan struct{}),
+	}
+	go t.read(stdout, logger)
+	return t, nil
+}
+
+func (t *stdioTransport) read(r io.Reader, logger Logger) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), 16<<20)
+	for scanner.Scan() {
+		var msg jsonrpcMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			logger.Println("Invalid message from MCP server:", err)
+			continue
+		}
+		switch {
+		case msg.ID != nil && msg.Method != "":
+			// request from the server
+			t.answer(msg)
+		case msg.ID != nil:
+			t.mu.Lock()
+			ch, ok := t.pending[*msg.ID]
+			delete(t.pending, *msg.ID)
+			t.mu.Unlock()
+			if ok {
+				ch <- msg
+			}
+		}
+	}
+	t.mu.Lock()
+	t.err = scanner.Err()
+	if t.err == nil {
+		t.err = errors.New("MCP server closed the connection")
+	}
+	t.mu.Unlock()
+	close(t.done)
+}
+
+// answer responds to requests of the server. Only ping is supported since the client declares no capabilities.
+func (t *stdioTransport) answer(req jsonrpcMessage) {
+	resp := jsonrpcMessage{JSONRPC: "2.0", ID: req.ID}
+	if req.Method == "ping" {
+		resp.Result = json.RawMessage("{}")
+	} else {
+		resp.Error = &jsonrpcErrorObj{Code: -32601, Message: "method not found"}
+	}
+	t.write(resp)
+}
+
+func (t *stdioTransport) write(msg jsonrpcMessage) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	_, err = t.stdin.Write(append(b, '\n'))
+	return err
+}
+
+func (t *stdioTransport) Call(ctx context.Context, req jsonrpcMessage) (jsonrpcMessage, error) {
+	ch := make(chan jsonrpcMessage, 1)
+	t.mu.Lock()
+	t.pending[*req.ID] = ch
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, *req.ID)
+		t.mu.Unlock()
+	}()
+
+	if err := t.write(req); err != nil {
+		return jsonrpcMessage{}, err
+	}
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-t.done:
+		return jsonrpcMessage{}, t.err
+	case <-ctx.Done():
+		return jsonrpcMessage{}, ctx.Err()
+	}
+}
+
+func (t *stdioTransport) Notify(ctx context.Context, msg jsonrpcMessage) error {
+	return t.write(msg)
+}
+
+func (t *stdioTransport) Close() error {
+	t.stdin.Close()
+	select {
+	case <-t.done:
+	case <-time.After(5 * time.Second):
+		t.cmd.Process.Kill()
+	}
+	return t.cmd.Wait()
+}
+
+// httpTransport implements the streamable HTTP transport.
+type httpTransport struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+
+	mu        sync.Mutex
+	sessionID string
+}
+
+func newHTTPTransport(c MCPServerConfig) *httpTransport {
+	return &httpTransport{url: c.URL, headers: c.Headers, client: &http.Client{}}
+}
+
+func (t *httpTransport) post(ctx context.Context, msg jsonrpcMessage) (*http.Response, error) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	req.Header.Set("MCP-Protocol-Version", mcpProtocolVersion)
+	for k, v := range t.headers {
+		req.Header.Set(k, os.ExpandEnv(v))
+	}
+	t.mu.Lock()
+	if t.sessionID != "" {
+		req.Header.Set("Mcp-Session-Id", t.sessionID)
+	}
+	t.mu.Unlock()
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if id := resp.Header.Get("Mcp-Session-Id"); id != "" {
+		t.mu.Lock()
+		t.sessionID = id
+		t.mu.Unlock()
+	}
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("MCP server returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+func (t *httpTransport) Call(ctx context.Context, req jsonrpcMessage) (jsonrpcMessage, error) {
+	resp, err := t.post(ctx, req)
+	if err != nil {
+		return jsonrpcMessage{}, err
+	}
+	defer resp.Body.Close()
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/event-stream" {
+		var msg jsonrpcMessage
+		err := json.NewDecoder(resp.Body).Decode(&msg)
+		return msg, err
+	}
+	// the response is one of the events of the stream
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64<<10), 16<<20)
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		if after, ok := strings.CutPrefix(line, "data:"); ok {
+			data.WriteString(strings.TrimPrefix(after, " "))
+			continue
+		}
+		if line != "" || data.Len() == 0 {
+			continue
+		}
+		var msg jsonrpcMessage
+		err := json.Unmarshal([]byte(data.String()), &msg)
+		data.Reset()
+		if err == nil && msg.ID != nil && *msg.ID == *req.ID && msg.Method == "" {
+			return msg, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return jsonrpcMessage{}, err
+	}
+	return jsonrpcMessage{}, errors.New("MCP server closed the stream without a response")
+}
+
+func (t *httpTransport) Notify(ctx context.Context, msg jsonrpcMessage) error {
+	resp, err := t.post(ctx, msg)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (t *httpTransport) Close() error {
+	t.mu.Lock()
+	sessionID := t.sessionID
+	t.mu.Unlock()
+	if sessionID == "" {
+		return nil
+	}
+	// terminate the session
+	req, err := http.NewRequest(http.MethodDelete, t.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Mcp-Session-Id", sessionID)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// MCPTool is a tool advertised by an MCP server
+type MCPTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"inputSchema"`
+}
+
+// MCPClient is a connection to an MCP server.
+type MCPClient struct {
+	Name      string
+	transport mcpTransport
+	nextID    atomic.Int64
+}
+
+// NewMCPClient starts or connects to the server and performs the initialization handshake.
+func NewMCPClient(ctx context.Context, name string, c MCPServerConfig, logger Logger) (*MCPClient, error) {
+	var t mcpTransport
+	if c.Command != "" {
+		st, err := newStdioTransport(c, logger)
+		if err != nil {
+			return nil, err
+		}
+		t = st
+	} else {
+		t = newHTTPTransport(c)
+	}
+	client := &MCPClient{Name: name, transport: t}
+
+	ctx, cancel := context.WithTimeout(ctx, mcpInitTimeout)
+	defer cancel()
+	_, err := client.call(ctx, "initialize", map[string]any{
+		"protocolVersion": mcpProtocolVersion,
+		"capabilities":    map[string]any{},
+		"clientInfo":      map[string]any{"name": "go-openai-discord", "version": "1.0.0"},
+	})
+	if err == nil {
+		err = t.Notify(ctx, jsonrpcMessage{JSONRPC: "2.0", Method: "notifications/initialized"})
+	}
+	if err != nil {
+		t.Close()
+		return nil, fmt.Errorf("initializing MCP server %q: %w", name, err)
+	}
+	return client, nil
+}
+
+func (c *MCPClient) call(ctx context.Context, method string, params any) (json.RawMessage, error) {
+	id := c.nextID.Add(1)
+	resp, err := c.transport.Call(ctx, jsonrpcMessage{JSONRPC: "2.0", ID: &id, Method: method, Params: params})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return resp.Result, nil
+}
+
+// ListTools returns all tools of the server
+func (c *MCPClient) ListTools(ctx context.Context) ([]MCPTool, error) {
+	var tools []MCPTool
+	cursor := ""
+	for {
+		params := map[string]any{}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+		result, err := c.call(ctx, "tools/list", params)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Tools      []MCPTool `json:"tools"`
+			NextCursor string    `json:"nextCursor"`
+		}
+		if err := json.Unmarshal(result, &page); err != nil {
+			return nil, err
+		}
+		tools = append(tools, page.Tools...)
+		if page.NextCursor == "" {
+			return tools, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// CallTool calls the tool and returns the text content of the result.
+func (c *MCPClient) CallTool(ctx context.Context, name string, args json.RawMessage) (string, error) {
+	result, err := c.call(ctx, "tools/call", map[string]any{"name": name, "arguments": args})
+	if err != nil {
+		return "", err
+	}
+	var r struct {
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+		StructuredContent json.RawMessage `json:"structuredContent"`
+		IsError           bool            `json:"isError"`
+	}
+	if err := json.Unmarshal(result, &r); err != nil {
+		return "", err
+	}
+	var parts []string
+	for _, c := range r.Content {
+		if c.Type == "text" {
+			parts = append(parts, c.Text)
+		} else {
+			parts = append(parts, fmt.Sprintf("[%s content omitted]", c.Type))
+		}
+	}
+	if len(parts) == 0 && len(r.StructuredContent) > 0 {
+		parts = append(parts, string(r.StructuredContent))
+	}
+	text := strings.Join(parts, "\n")
+	if r.IsError {
+		return "", errors.New(text)
+	}
+	return text, nil
+}
+
+func (c *MCPClient) Close() error {
+	return c.transport.Close()
+}
+
+var toolNameInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// mcpToolName returns the name under which the tool of the server is exposed to the model
+func mcpToolName(server, tool string) string {
+	name := toolNameInvalidChars.ReplaceAllString(server, "_") + "__" + toolNameInvalidChars.ReplaceAllString(tool, "_")
+	return name[:min(len(name), 64)]
+}
+
+// RegisterTools registers the tools of the server in the registry.
+// Tools which cannot be registered, e.g. because of a name conflict, are skipped and reported in the error.
+func (c *MCPClient) RegisterTools(ctx context.Context, r *ToolRegistry) error {
+	tools, err := c.ListTools(ctx)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, t := range tools {
+		name := t.Name
+		err := r.Register(Tool{
+			Name:        mcpToolName(c.Name, t.Name),
+			Description: fmt.Sprintf("[%s] %s", c.Name, t.Description),
+			Parameters:  t.InputSchema,
+			Handler: func(ctx context.Context, tc ToolContext, args json.RawMessage) (string, error) {
+				return c.CallTool(ctx, name, args)
+			},
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// connectMCPServers connects to the servers of the configuration and registers their tools.
+// Servers failing to start are logged and skipped so that one broken server does not take the bot down.
+func connectMCPServers(ctx context.Context, c MCPConfig, r *ToolRegistry, logger Logger) []*MCPClient {
+	names := make([]string, 0, len(c.Servers))
+	for name := range c.Servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var clients []*MCPClient
+	for _, name := range names {
+		client, err := NewMCPClient(ctx, name, c.Servers[name], logger)
+		if err != nil {
+			logger.Println("Error connecting to MCP server:", err)
+			continue
+		}
+		if err := client.RegisterTools(ctx, r); err != nil {
+			logger.Println("Error registering tools of MCP server", name+":", err)
+		}
+		logger.Println("Connected to MCP server", name)
+		clients = append(clients, client)
+	}
+	return clients
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// environment variable making the test binary act as a stdio MCP server
+const mcpStubEnv = "GO_OPENAI_DISCORD_MCP_STUB"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(mcpStubEnv) == "1" {
+		runMCPStub()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// handleMCPStub answers a JSON-RPC request like a server with the tools "add" and "fail".
+func handleMCPStub(req jsonrpcMessage) *jsonrpcMessage {
+	if req.ID == nil {
+		// notification
+		return nil
+	}
+	resp := &jsonrpcMessage{JSONRPC: "2.0", ID: req.ID}
+	switch req.Method {
+	case "initialize":
+		resp.Result = json.RawMessage(`{"protocolVersion":"` + mcpProtocolVersion + `","capabilities":{"tools":{}},"serverInfo":{"name":"stub","version":"0"}}`)
+	case "tools/list":
+		resp.Result = json.RawMessage(`{"tools":[
+			{"name":"add","description":"Add two numbers","inputSchema":{"type":"object","properties":{"a":{"type":"number"},"b":{"type":"number"}}}},
+			{"name":"fail","description":"Always fails","inputSchema":{"type":"object"}}
+		]}`)
+	case "tools/call":
+		var p struct {
+			Name      string `json:"name"`
+			Arguments struct {
+				A, B float64
+			} `json:"arguments"`
+		}
+		b, _ := json.Marshal(req.Params)
+		json.Unmarshal(b, &p)
+		switch p.Name {
+		case "add":
+			resp.Result = json.RawMessage(fmt.Sprintf(`{"content":[{"type":"text","text":"%g"}]}`, p.Arguments.A+p.Arguments.B))
+		default:
+			resp.Result = json.RawMessage(`{"content":[{"type":"text","text":"it failed"}],"isError":true}`)
+		}
+	default:
+		resp.Error = &jsonrpcErrorObj{Code: -32601, Message: "method not found"}
+	}
+	return resp
+}
+
+func runMCPStub() {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var req jsonrpcMessage
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			continue
+		}
+		if resp := handleMCPStub(req); resp != nil {
+			b, _ := json.Marshal(resp)
+			os.Stdout.Write(append(b, '\n'))
+		}
+	}
+}
+
+func newHTTPMCPStub(t *testing.T, sse bool) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			return
+		}
+		var req jsonrpcMessage
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Method != "initialize" && r.Header.Get("Mcp-Session-Id") != "session-1" {
+			http.Error(w, "missing session", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Mcp-Session-Id", "session-1")
+		resp := handleMCPStub(req)
+		if resp == nil {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		b, _ := json.Marshal(resp)
+		if sse {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprintf(w, "event: message\ndata: {\"jsonrpc\":\"2.0\",\"method\":\"notifications/progress\"}\n\ndata: %s\n\n", b)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestMCPClient(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		config func(t *testing.T) MCPServerConfig
+	}{
+		{"Stdio", func(t *testing.T) MCPServerConfig {
+			return MCPServerConfig{Command: exe, Env: map[string]string{mcpStubEnv: "1"}}
+		}},
+		{"HTTP", func(t *testing.T) MCPServerConfig {
+			return MCPServerConfig{URL: newHTTPMCPStub(t, false).URL}
+		}},
+		{"HTTPStream", func(t *testing.T) MCPServerConfig {
+			return MCPServerConfig{URL: newHTTPMCPStub(t, true).URL}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			client, err := NewMCPClient(ctx, "stub server", test.config(t), &MockLogger{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			r := NewToolRegistry()
+			if err := client.RegisterTools(ctx, r); err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, d := range r.Definitions() {
+				names = append(names, d.Function.Name)
+			}
+			if strings.Join(names, ",") != "stub_server__add,stub_server__fail" {
+				t.Errorf("unexpected tools %v", names)
+			}
+
+			got := r.Call(ctx, ToolContext{}, fakeToolCall("1", "stub_server__add", map[string]int{"a": 1, "b": 2}), 0)
+			if got != "3" {
+				t.Errorf("expected 3, got %q", got)
+			}
+			got = r.Call(ctx, ToolContext{}, fakeToolCall("2", "stub_server__fail", nil), 0)
+			if got != "error: it failed" {
+				t.Errorf("expected the tool error, got %q", got)
+			}
+		})
+	}
+}
+
+func TestLoadMCPConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"Valid", `{"mcpServers":{"a":{"command":"server"},"b":{"url":"http://localhost/mcp"}}}`, false},
+		{"Neither", `{"mcpServers":{"a":{}}}`, true},
+		{"Both", `{"mcpServers":{"a":{"command":"server","url":"http://localhost/mcp"}}}`, true},
+		{"InvalidJSON", `{`, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := t.TempDir() + "/mcp.json"
+			os.WriteFile(path, []byte(test.content), 0o600)
+			_, err := loadMCPConfig(path)
+			if (err != nil) != test.wantErr {
+				t.Errorf("loadMCPConfig returned %v, want error: %v", err, test.wantErr)
+			}
+		})
+	}
+}
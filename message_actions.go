@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// minutes after which the threads of message actions are archived
+const messageActionThreadArchive = 60
+
+// messageAction is a command of the message context menu applying an instruction to the message.
+type messageAction struct {
+	Name        string
+	Instruction string
+}
+
+var messageActions = []messageAction{
+	{"Explain this", "Explain the following Discord message in simple terms. Give background where it helps."},
+	{"Summarize this", "Summarize the following Discord message in a few bullet points."},
+	{"Translate to English", "Translate the following Discord message to English. Only output the translation."},
+	{"Review this code", "Review the code in the following Discord message. Point out bugs, security problems and " +
+		"readability issues, and suggest improvements with short code examples."},
+}
+
+// messageActionCommands returns the context menu commands of the message actions
+func messageActionCommands() []*discordgo.ApplicationCommand {
+	var cmds []*discordgo.ApplicationCommand
+	for _, a := range messageActions {
+		cmds = append(cmds, &discordgo.ApplicationCommand{
+			Name: a.Name,
+			Type: discordgo.MessageApplicationCommand,
+		})
+	}
+	return cmds
+}
+
+// threadName returns a single line thread name within the limit of 100 characters
+func threadName(s string) string {
+	return truncate(strings.Join(strings.Fields(s), " "), 90)
+}
+
+func findMessageAction(name string) (messageAction, bool) {
+	for _, a := range messageActions {
+		if a.Name == name {
+			return a, true
+		}
+	}
+	return messageAction{}, false
+}
+
+// functional option to answer message actions in a thread started from the target message instead of privately
+func WithMessageActionThreads(enabled bool) ChatBotOption {
+	return func(s *OpenAIChatBot) {
+		s.messageActionThreads.Store(enabled)
+	}
+}
+
+// HandleMessageAction handles the commands of the message context menu.
+// The answer is only visible to the user unless threads are enabled, in which case it is posted to a thread on the message.
+func (bot *OpenAIChatBot) HandleMessageAction(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	data := i.ApplicationCommandData()
+	action, ok := findMessageAction(data.Name)
+	if !ok {
+		bot.logger.Println("Unknown message action:", data.Name)
+		return
+	}
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral},
+	})
+	if err != nil {
+		bot.logger.Println("Error responding to interaction:", err)
+	}
+
+	var target *discordgo.Message
+	if data.Resolved != nil {
+		target = data.Resolved.Messages[data.TargetID]
+	}
+	if target == nil || strings.TrimSpace(target.Content) == "" {
+		bot.sendFollowup(s, i, "The message has no text to work with.", discordgo.MessageFlagsEphemeral)
+		return
+	}
+
+	meta := interactionMeta("message_action", s, i)
+	content := target.Content
+	// the message of someone else must not be able to instruct the bot or use tools on behalf of the user
+	if target.Author == nil || target.Author.ID != meta.UserID {
+		if err := bot.checkUntrusted(meta, content); err != nil {
+			bot.sendFollowup(s, i, bot.interactionError(err), discordgo.MessageFlagsEphemeral)
+			return
+		}
+		meta.Untrusted = true
+		content = wrapUntrusted(content)
+	}
+	prompt := action.Instruction + "\n\n" + content
+	answer, err := bot.completeOnce(context.Background(), meta, prompt)
+	if err != nil {
+		bot.sendFollowup(s, i, bot.interactionError(err), discordgo.MessageFlagsEphemeral)
+		return
+	}
+
+	if bot.messageActionThreads.Load() && i.GuildID != "" {
+		th, err := s.MessageThreadStart(i.ChannelID, target.ID, threadName(action.Name+": "+target.Content), messageActionThreadArchive)
+		if err == nil {
+			for _, r := range splitMessage(answer, 2000) {
+				if _, err := bot.sender.ChannelSend(s, th.ID, r); err != nil {
+					bot.logger.Println("Error sending to thread:", err)
+				}
+			}
+			bot.sendFollowup(s, i, fmt.Sprintf("Answered in <#%s>.", th.ID), discordgo.MessageFlagsEphemeral)
+			return
+		}
+		// e.g. the message is in a thread already or the bot may not create threads
+		bot.logger.Println("Error starting thread, answering privately:", err)
+	}
+	bot.sendFollowup(s, i, answer, discordgo.MessageFlagsEphemeral)
+}
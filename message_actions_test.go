@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/ewohltman/discordgo-mock/mockconstants"
+)
+
+func messageActionInteraction(name, content string) *discordgo.InteractionCreate {
+	i := commandInteraction(name)
+	i.Data = discordgo.ApplicationCommandInteractionData{
+		Name:        name,
+		CommandType: discordgo.MessageApplicationCommand,
+		TargetID:    "target",
+		Resolved: &discordgo.ApplicationCommandInteractionDataResolved{
+			Messages: map[string]*discordgo.Message{
+				"target": {ID: "target", ChannelID: mockconstants.TestChannel, Content: content},
+			},
+		},
+	}
+	return i
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// acceptThreads makes the session answer thread creation with a thread of the given ID
+func acceptThreads(s *discordgo.Session, threadID string) {
+	next := s.Client.Transport
+	s.Client.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Method == http.MethodPost && strings.HasSuffix(req.URL.Path, "/threads") {
+			body := `{"id":"` + threadID + `","type":11}`
+			return &http.Response{StatusCode: http.StatusCreated, Body: io.NopCloser(strings.NewReader(body)), Header: http.Header{}, Request: req}, nil
+		}
+		return next.RoundTrip(req)
+	})
+}
+
+func TestHandleMessageAction(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		threads   bool
+		accept    bool
+		followup  string
+		thread    string
+		responses int
+	}{
+		{"Private", "¿Dónde está la biblioteca?", false, false, "Where is the library?", "", 1},
+		{"NoText", "", false, false, "The message has no text to work with.", "", 0},
+		{"Thread", "¿Dónde está la biblioteca?", true, true, "Answered in <#thread>.", "Where is the library?", 1},
+		{"ThreadFailed", "¿Dónde está la biblioteca?", true, false, "Where is the library?", "", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeOpenAI(t, fakeResponse{Content: "Where is the library?"})
+			bot, sender := newTestOpenAIChatBot(t, fake, WithMessageActionThreads(test.threads))
+			s := newSession()
+			if test.accept {
+				acceptThreads(s, "thread")
+			}
+			recorder := recordInteractions(s)
+
+			bot.HandleMessageAction(s, messageActionInteraction("Translate to English", test.content))
+
+			if len(recorder.responses) != 1 || recorder.responses[0].Data.Flags != discordgo.MessageFlagsEphemeral {
+				t.Errorf("expected an ephemeral deferred response, got %#v", recorder.responses)
+			}
+			if len(sender.Followups) != 1 || strings.TrimSpace(sender.Followups[0].Content) != test.followup ||
+				sender.Followups[0].Flags != discordgo.MessageFlagsEphemeral {
+				t.Errorf("expected followup %q, got %#v", test.followup, sender.Followups)
+			}
+			if got := strings.TrimSpace(strings.Join(sender.Messages["thread"], "")); got != test.thread {
+				t.Errorf("expected %q in the thread, got %q", test.thread, got)
+			}
+			reqs := fake.Requests()
+			if len(reqs) != test.responses {
+				t.Fatalf("expected %d requests, got %d", test.responses, len(reqs))
+			}
+			if len(reqs) > 0 && !strings.HasSuffix(reqs[0].Messages[1].Content, "\n\n"+wrapUntrusted(test.content)) {
+				t.Errorf("expected the instruction and the message, got %q", reqs[0].Messages[1].Content)
+			}
+		})
+	}
+}
+
+func TestThreadName(t *testing.T) {
+	got := threadName("Explain this: " + strings.Repeat("line\n", 50))
+	if strings.Contains(got, "\n") || len([]rune(got)) > 100 {
+		t.Errorf("expected a single line of at most 100 characters, got %q", got)
+	}
+}
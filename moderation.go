@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// classifiers of the moderation stage
+const (
+	ModerationOpenAI = "openai"
+	ModerationLocal  = "local"
+)
+
+// what happens to flagged content
+const (
+	ModerationBlock  = "block"
+	ModerationRedact = "redact"
+)
+
+// replacement of redacted content
+const moderationRedacted = "[removed by moderation]"
+
+// key of the thresholds applying to all guilds or all categories
+const moderationAny = "*"
+
+// ModerationThresholds maps guild IDs to category scores at which content is flagged.
+// The key "*" matches all guilds or all categories.
+type ModerationThresholds map[string]map[string]float64
+
+type ModerationConfig struct {
+	// ModerationOpenAI or ModerationLocal, moderation is disabled if empty
+	Classifier string
+	// model of the moderation endpoint
+	Model string
+	// path of the JSON file mapping categories to regular expressions for the local classifier
+	WordlistPath string
+	// ModerationBlock or ModerationRedact
+	Action string
+	// score at which content is flagged unless Thresholds says otherwise
+	Threshold  float64
+	Thresholds ModerationThresholds
+	// channel incidents are posted to, incidents are only logged if empty
+	LogChannel string
+}
+
+func moderationConfigFromEnv() (ModerationConfig, error) {
+	c := ModerationConfig{
+		Classifier:   os.Getenv("MODERATION"),
+		Model:        envString("MODERATION_MODEL", openai.ModerationOmniLatest),
+		WordlistPath: os.Getenv("MODERATION_WORDLIST"),
+		Action:       envString("MODERATION_ACTION", ModerationBlock),
+		LogChannel:   os.Getenv("MODERATION_LOG_CHANNEL"),
+	}
+	var err error
+	if c.Threshold, err = envFloat("MODERATION_THRESHOLD", 0.5); err != nil {
+		return c, err
+	}
+	if path := os.Getenv("MODERATION_THRESHOLDS"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return c, err
+		}
+		if err := json.Unmarshal(b, &c.Thresholds); err != nil {
+			return c, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	switch {
+	case c.Classifier != "" && c.Classifier != ModerationOpenAI && c.Classifier != ModerationLocal:
+		return c, fmt.Errorf("MODERATION must be %q or %q, got %q", ModerationOpenAI, ModerationLocal, c.Classifier)
+	case c.Classifier == ModerationLocal && c.WordlistPath == "":
+		return c, errors.New("MODERATION_WORDLIST is required for the local classifier")
+	case c.Action != ModerationBlock && c.Action != ModerationRedact:
+		return c, fmt.Errorf("MODERATION_ACTION must be %q or %q, got %q", ModerationBlock, ModerationRedact, c.Action)
+	}
+	return c, nil
+}
+
+// threshold returns the score at which content of the category is flagged in the guild
+func (c ModerationConfig) threshold(guildID, category string) float64 {
+	for _, g := range []string{guildID, moderationAny} {
+		for _, cat := range []string{category, moderationAny} {
+			if t, ok := c.Thresholds[g][cat]; ok {
+				return t
+			}
+		}
+	}
+	return c.Threshold
+}
+
+// Classification rates a text
+type Classification struct {
+	// scores of the categories between 0 and 1
+	Scores map[string]float64
+	// byte ranges of the text matching the categories, nil if the classifier only rates whole texts
+	Spans map[string][][]int
+}
+
+// Classifier rates texts for moderation
+type Classifier interface {
+	Classify(ctx context.Context, text string) (Classification, error)
+}
+
+// openAIClassifier uses the moderation endpoint
+type openAIClassifier struct {
+	// the client of the bot, which is set up after the options
+	client *openai.Client
+	model  string
+}
+
+func (c *openAIClassifier) Classify(ctx context.Context, text string) (Classification, error) {
+	resp, err := c.client.Moderations(ctx, openai.ModerationRequest{Input: text, Model: c.model})
+	if err != nil {
+		return Classification{}, err
+	}
+	if len(resp.Results) == 0 {
+		return Classification{}, errors.New("moderation returned no results")
+	}
+	// the categories are struct fields, their JSON names are the category names
+	b, err := json.Marshal(resp.Results[0].CategoryScores)
+	if err != nil {
+		return Classification{}, err
+	}
+	var scores map[string]float64
+	if err := json.Unmarshal(b, &scores); err != nil {
+		return Classification{}, err
+	}
+	return Classification{Scores: scores}, nil
+}
+
+// wordlistClassifier scores a category 1 if one of its regular expressions matches
+type wordlistClassifier struct {
+	patterns map[string][]*regexp.Regexp
+}
+
+// loadWordlist reads a JSON file mapping categories to regular expressions, which are matched case-insensitively
+func loadWordlist(path string) (*wordlistClassifier, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lists map[string][]string
+	if err := json.Unmarshal(b, &lists); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	c := &wordlistClassifier{patterns: make(map[string][]*regexp.Regexp)}
+	for category, exprs := range lists {
+		for _, expr := range exprs {
+			re, err := regexp.Compile("(?i)" + expr)
+			if err != nil {
+				return nil, fmt.Errorf("%s: category %s: %w", path, category, err)
+			}
+			c.patterns[category] = append(c.patterns[category], re)
+		}
+	}
+	return c, nil
+}
+
+func (c *wordlistClassifier) Classify(_ context.Context, text string) (Classification, error) {
+	result := Classification{Scores: make(map[string]float64), Spans: make(map[string][][]int)}
+	for category, patterns := range c.patterns {
+		for _, re := range patterns {
+			result.Spans[category] = append(result.Spans[category], re.FindAllStringIndex(text, -1)...)
+		}
+		if len(result.Spans[category]) > 0 {
+			result.Scores[category] = 1
+		}
+	}
+	return result, nil
+}
+
+// ModerationVerdict is the outcome of moderating a text
+type ModerationVerdict struct {
+	// flagged categories in alphabetical order, empty if the text is fine
+	Categories []string
+	Scores     map[string]float64
+	// the text with the flagged content redacted
+	Redacted string
+}
+
+func (v ModerationVerdict) Flagged() bool {
+	return len(v.Categories) > 0
+}
+
+// Moderator checks texts against the thresholds of the guild
+type Moderator struct {
+	config     ModerationConfig
+	classifier Classifier
+}
+
+func NewModerator(c ModerationConfig, classifier Classifier) *Moderator {
+	return &Moderator{config: c, classifier: classifier}
+}
+
+// Check classifies the text and flags the categories reaching the thresholds of the guild.
+func (m *Moderator) Check(ctx context.Context, guildID, text string) (ModerationVerdict, error) {
+	result, err := m.classifier.Classify(ctx, text)
+	if err != nil {
+		return ModerationVerdict{}, err
+	}
+	v := ModerationVerdict{Scores: result.Scores, Redacted: text}
+	var spans [][]int
+	for category, score := range result.Scores {
+		if score >= m.config.threshold(guildID, category) {
+			v.Categories = append(v.Categories, category)
+			spans = append(spans, result.Spans[category]...)
+		}
+	}
+	if !v.Flagged() {
+		return v, nil
+	}
+	sort.Strings(v.Categories)
+	if result.Spans == nil {
+		v.Redacted = moderationRedacted
+	} else {
+		v.Redacted = redactSpans(text, spans)
+	}
+	return v, nil
+}
+
+// redactSpans replaces the byte ranges of the text, which may overlap
+func redactSpans(text string, spans [][]int) string {
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+	var sb strings.Builder
+	pos := 0
+	for _, span := range spans {
+		if span[1] <= pos {
+			continue
+		}
+		if span[0] >= pos {
+			sb.WriteString(text[pos:span[0]])
+			sb.WriteString(moderationRedacted)
+		}
+		pos = span[1]
+	}
+	sb.WriteString(text[pos:])
+	return sb.String()
+}
+
+// functional option to moderate prompts and replies
+func WithModeration(c ModerationConfig) ChatBotOption {
+	return func(s *OpenAIChatBot) {
+		m, err := s.newModerator(c)
+		if err != nil {
+			s.logger.Fatal("Error loading moderation wordlist: ", err)
+		}
+		s.moderation.Store(m)
+	}
+}
+
+// newModerator returns the moderator of the configuration, nil if moderation is disabled
+func (bot *OpenAIChatBot) newModerator(c ModerationConfig) (*Moderator, error) {
+	switch c.Classifier {
+	case ModerationOpenAI:
+		return NewModerator(c, &openAIClassifier{client: &bot.client, model: c.Model}), nil
+	case ModerationLocal:
+		wordlist, err := loadWordlist(c.WordlistPath)
+		if err != nil {
+			return nil, err
+		}
+		return NewModerator(c, wordlist), nil
+	}
+	return nil, nil
+}
+
+// moderate checks the text of a prompt or reply.
+// Flagged text is reported to the moderators and either blocked with a userFacingError or returned redacted.
+// Text is let through if the classifier fails.
+func (bot *OpenAIChatBot) moderate(ctx context.Context, meta requestMeta, text string, reply bool) (string, error) {
+	m := bot.moderation.Load()
+	if m == nil || strings.TrimSpace(text) == "" {
+		return text, nil
+	}
+	v, err := m.Check(ctx, meta.GuildID, text)
+	if err != nil {
+		bot.logger.Println("Error moderating content:", err)
+		return text, nil
+	}
+	if !v.Flagged() {
+		return text, nil
+	}
+	blocked := m.config.Action == ModerationBlock
+	bot.reportIncident(m.config.LogChannel, meta, v, text, reply, blocked)
+	categories := strings.Join(v.Categories, ", ")
+	switch {
+	case blocked && reply:
+		return "", &userFacingError{fmt.Sprintf("The reply was withheld by moderation (%s).", categories)}
+	case blocked:
+		return "", &userFacingError{fmt.Sprintf("Your message was blocked by moderation (%s).", categories)}
+	case reply:
+		return v.Redacted + "\n\n-# Parts of this reply were removed by moderation.", nil
+	}
+	return v.Redacted, nil
+}
+
+// reportIncident logs flagged content and posts it to the moderation log channel
+func (bot *OpenAIChatBot) reportIncident(logChannel string, meta requestMeta, v ModerationVerdict, text string, reply, blocked bool) {
+	what := "message of <@" + meta.UserID + ">"
+	if reply {
+		what = "reply to <@" + meta.UserID + ">"
+	}
+	action := "Redacted"
+	if blocked {
+		action = "Blocked"
+	}
+	var scores []string
+	for _, c := range v.Categories {
+		scores = append(scores, fmt.Sprintf("%s %.2f", c, v.Scores[c]))
+	}
+	msg := fmt.Sprintf("🚩 %s a %s in <#%s> (%s):\n||%s||", action, what, meta.ChannelID, strings.Join(scores, ", "),
+		truncate(strings.ReplaceAll(text, "||", ""), 1500))
+	bot.logger.Println("Moderation:", action, meta.Kind, meta.GuildID, meta.ChannelID, meta.UserID, strings.Join(scores, ", "))
+	if logChannel == "" || meta.Session == nil {
+		return
+	}
+	// sent without the sender, which would log the flagged text. Mentions in the text must not ping anyone, nor the user named.
+	data := &discordgo.MessageSend{Content: msg, AllowedMentions: &discordgo.MessageAllowedMentions{}}
+	if _, err := meta.Session.ChannelMessageSendComplex(logChannel, data); err != nil {
+		bot.logger.Println("Error sending moderation incident:", err)
+	}
+}
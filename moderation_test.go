@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/ewohltman/discordgo-mock/mockconstants"
+)
+
+// recordPosts makes the session record the messages posted to the channel through the API
+func recordPosts(s *discordgo.Session, channelID string) *[]discordgo.MessageSend {
+	var posts []discordgo.MessageSend
+	next := s.Client.Transport
+	s.Client.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Method != http.MethodPost || !strings.HasSuffix(req.URL.Path, "/channels/"+channelID+"/messages") {
+			return next.RoundTrip(req)
+		}
+		var data discordgo.MessageSend
+		if err := json.NewDecoder(req.Body).Decode(&data); err != nil {
+			return nil, err
+		}
+		posts = append(posts, data)
+		body := `{"id":"posted","channel_id":"` + channelID + `"}`
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body)), Header: http.Header{}, Request: req}, nil
+	})
+	return &posts
+}
+
+func TestModerationThreshold(t *testing.T) {
+	c := ModerationConfig{
+		Threshold: 0.5,
+		Thresholds: ModerationThresholds{
+			"*":      {"violence": 0.8},
+			"strict": {"*": 0.1, "hate": 0.05},
+		},
+	}
+	tests := []struct {
+		guildID, category string
+		want              float64
+	}{
+		{"guild", "hate", 0.5},
+		{"guild", "violence", 0.8},
+		{"strict", "hate", 0.05},
+		{"strict", "violence", 0.1},
+		{"strict", "sexual", 0.1},
+	}
+	for _, test := range tests {
+		if got := c.threshold(test.guildID, test.category); got != test.want {
+			t.Errorf("%s/%s: expected %v, got %v", test.guildID, test.category, test.want, got)
+		}
+	}
+}
+
+func TestWordlistModeration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wordlist.json")
+	if err := os.WriteFile(path, []byte(`{"insult": ["\\bidiot\\b", "stupid idiot"], "spam": ["buy now"]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	classifier, err := loadWordlist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewModerator(ModerationConfig{Threshold: 0.5, Thresholds: ModerationThresholds{"shop": {"spam": 2}}}, classifier)
+
+	tests := []struct {
+		name       string
+		guildID    string
+		text       string
+		categories []string
+		redacted   string
+	}{
+		{"Clean", "guild", "hello there", nil, "hello there"},
+		{"Overlapping", "guild", "You Stupid Idiot, BUY NOW", []string{"insult", "spam"}, "You [removed by moderation], [removed by moderation]"},
+		{"GuildThreshold", "shop", "buy now", nil, "buy now"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v, err := m.Check(context.Background(), test.guildID, test.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(v.Categories, test.categories) {
+				t.Errorf("expected categories %v, got %v", test.categories, v.Categories)
+			}
+			if v.Redacted != test.redacted {
+				t.Errorf("expected %q, got %q", test.redacted, v.Redacted)
+			}
+		})
+	}
+}
+
+func TestModerationReply(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    ModerationConfig
+		prompt    string
+		answer    string
+		reply     string
+		requests  int
+		incidents int
+		inContext string
+	}{
+		{
+			name:      "Clean",
+			config:    ModerationConfig{Action: ModerationBlock},
+			prompt:    "hello",
+			answer:    "Hi!",
+			reply:     "Hi!\n",
+			requests:  1,
+			inContext: "hello",
+		},
+		{
+			name:      "BlockedPrompt",
+			config:    ModerationConfig{Action: ModerationBlock},
+			prompt:    "@everyone some violence please",
+			reply:     "Your message was blocked by moderation (violence).",
+			requests:  0,
+			incidents: 1,
+		},
+		{
+			name:      "WithheldReply",
+			config:    ModerationConfig{Action: ModerationBlock},
+			prompt:    "hello",
+			answer:    "Here is some hate.",
+			reply:     "The reply was withheld by moderation (hate).",
+			requests:  1,
+			incidents: 1,
+		},
+		{
+			name:      "RedactedReply",
+			config:    ModerationConfig{Action: ModerationRedact},
+			prompt:    "hello",
+			answer:    "Here is some hate.",
+			reply:     "[removed by moderation]\n\n-# Parts of this reply were removed by moderation.\n",
+			requests:  1,
+			incidents: 1,
+			inContext: "hello",
+		},
+		{
+			name:      "RedactedPrompt",
+			config:    ModerationConfig{Action: ModerationRedact},
+			prompt:    "some violence please",
+			answer:    "Hi!",
+			reply:     "Hi!\n",
+			requests:  1,
+			incidents: 1,
+			inContext: "[removed by moderation]",
+		},
+		{
+			name:      "GuildThreshold",
+			config:    ModerationConfig{Action: ModerationBlock, Thresholds: ModerationThresholds{mockconstants.TestGuild: {"violence": 0.9}}},
+			prompt:    "some violence please",
+			answer:    "Hi!",
+			reply:     "Hi!\n",
+			requests:  1,
+			inContext: "some violence please",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeOpenAI(t, fakeResponse{Content: test.answer})
+			config := test.config
+			config.Classifier = ModerationOpenAI
+			config.Threshold = 0.5
+			config.LogChannel = "mods"
+			logger := &MockLogger{}
+			bot, sender := newTestOpenAIChatBot(t, fake, WithModeration(config), WithLogger(logger))
+			s := newSession()
+			posts := recordPosts(s, "mods")
+
+			bot.HandleReply(s, mentionMessage(test.prompt))
+
+			if got := sender.Messages[mockconstants.TestChannel]; len(got) != 1 || got[0] != test.reply {
+				t.Errorf("expected reply %q, got %#v", test.reply, got)
+			}
+			if got := len(fake.Requests()); got != test.requests {
+				t.Errorf("expected %d chat requests, got %d", test.requests, got)
+			}
+			incidents := *posts
+			if len(incidents) != test.incidents {
+				t.Errorf("expected %d incidents, got %#v", test.incidents, incidents)
+			}
+			for _, incident := range incidents {
+				if !strings.Contains(incident.Content, "<@"+mockconstants.TestUser+">") || !strings.Contains(incident.Content, "0.70") {
+					t.Errorf("expected the incident to name the user and score, got %q", incident.Content)
+				}
+				if m := incident.AllowedMentions; m == nil || len(m.Parse) != 0 || len(m.Users) != 0 || len(m.Roles) != 0 {
+					t.Errorf("expected the incident not to ping anyone, got %#v", m)
+				}
+			}
+			for _, l := range logger.GetPrintLogs() {
+				if test.incidents > 0 && strings.Contains(l, "violence please") || strings.Contains(l, "some hate") {
+					t.Errorf("expected the flagged text not to be logged, got %q", l)
+				}
+			}
+			var prompts []string
+			for _, msg := range bot.chatContext[mockconstants.TestChannel].Messages {
+				if msg.Role == "user" {
+					prompts = append(prompts, strings.TrimSpace(msg.Content))
+				}
+			}
+			if test.inContext == "" && len(prompts) != 0 || test.inContext != "" && !slices.Equal(prompts, []string{test.inContext}) {
+				t.Errorf("expected %q in the context, got %#v", test.inContext, prompts)
+			}
+		})
+	}
+}
@@ -2,7 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 	openai "github.com/sashabaranov/go-openai"
@@ -10,10 +16,146 @@ import (
 
 type OpenAIChatBot struct {
 	BaseChatBot
-	client      openai.Client
-	chatContext map[string]openai.ChatCompletionRequest
+	client openai.Client
+	// client configuration overriding the environment variables
+	clientConfig *openai.ClientConfig
+	mu           sync.Mutex
+	chatContext  map[string]conversation
+	audit        *AuditLog
+	tools        *ToolRegistry
+	toolConfig   ToolConfig
+	rag          *RAGRetriever
+	knowledge    *KnowledgeBase
+	personas     *PersonaLibrary
+	keys         *KeyPool
+	// answer message actions in threads instead of privately
+	messageActionThreads atomic.Bool
+	usage                *UsageStore
+	rateLimitConfig      RateLimitConfig
+	limits               atomic.Pointer[RateLimiter]
+	budget               atomic.Pointer[Budget]
+	moderation           atomic.Pointer[Moderator]
+	redactor             atomic.Pointer[Redactor]
+	injections           atomic.Pointer[InjectionDetector]
 }
 
+// conversation is the context of a channel
+type conversation struct {
+	openai.ChatCompletionRequest
+	// turns describes the message at the same index of Messages
+	turns []turn
+}
+
+// turn is what the bot knows about a message of a conversation besides what is sent to the model
+type turn struct {
+	// user who wrote a prompt
+	AuthorID string
+	// last Discord message of an assistant reply, which carries the reply buttons
+	MessageID string
+}
+
+// with returns a copy of the conversation keeping the first n messages and appending msgs
+func (c conversation) with(n int, msgs ...openai.ChatCompletionMessage) conversation {
+	c.Messages = append(append([]openai.ChatCompletionMessage{}, c.Messages[:n]...), msgs...)
+	c.turns = append(append([]turn{}, c.turns[:n]...), make([]turn, len(msgs))...)
+	return c
+}
+
+// request returns the first n messages for a request of the user.
+// Prompts of other users are delimited as untrusted. Whether the messages have untrusted content, including earlier tool results,
+// is reported so that the model may not call tools on behalf of the user.
+func (c conversation) request(n int, userID string) (openai.ChatCompletionRequest, bool) {
+	req := c.with(n).ChatCompletionRequest
+	untrusted := false
+	for i, t := range c.turns[:n] {
+		msg := &req.Messages[i]
+		switch {
+		case t.AuthorID != "" && t.AuthorID != userID:
+			msg.Content = wrapUntrusted(msg.Content)
+			untrusted = true
+		case msg.Role == openai.ChatMessageRoleTool && isWrappedUntrusted(msg.Content):
+			untrusted = true
+		}
+	}
+	return req, untrusted
+}
+
+// isLatestReply reports whether the last message of the conversation is the reply the interaction was triggered on.
+// Older replies keep their buttons, but only the latest one can be changed.
+func (c conversation) isLatestReply(i *discordgo.InteractionCreate) bool {
+	n := len(c.Messages)
+	if n == 0 || c.Messages[n-1].Role != openai.ChatMessageRoleAssistant {
+		return false
+	}
+	return i.Message == nil || c.turns[n-1].MessageID == i.Message.ID
+}
+
+const defaultSystemPrompt = "you are a helpful chatbot"
+
+const defaultModel = "gpt-5.2"
+
+// requestMeta describes where a completion request comes from
+type requestMeta struct {
+	// what triggered the request, e.g. "reply" or "regenerate"
+	Kind      string
+	Session   *discordgo.Session
+	GuildID   string
+	ChannelID string
+	UserID    string
+	// display name of the user in the server
+	UserName string
+	// roles of the user in the server
+	RoleIDs []string
+	// the request contains content of other people, so the model may not call tools
+	Untrusted bool
+	// Status shows progress such as tool calls to the user if not nil
+	Status func(text string)
+}
+
+func messageMeta(kind string, s *discordgo.Session, m *discordgo.MessageCreate) requestMeta {
+	meta := requestMeta{Kind: kind, Session: s, GuildID: m.GuildID, ChannelID: m.ChannelID}
+	if m.Author != nil {
+		meta.UserID = m.Author.ID
+		meta.UserName = m.Author.DisplayName()
+	}
+	if m.Member != nil {
+		if m.Member.Nick != "" {
+			meta.UserName = m.Member.Nick
+		}
+		meta.RoleIDs = m.Member.Roles
+	}
+	return meta
+}
+
+func interactionMeta(kind string, s *discordgo.Session, i *discordgo.InteractionCreate) requestMeta {
+	meta := requestMeta{Kind: kind, Session: s, GuildID: i.GuildID, ChannelID: i.ChannelID, UserID: interactionUserID(i)}
+	if i.Member != nil && i.Member.User != nil {
+		meta.UserName = i.Member.DisplayName()
+		meta.RoleIDs = i.Member.Roles
+	} else if i.User != nil {
+		meta.UserName = i.User.DisplayName()
+	}
+	return meta
+}
+
+func (meta requestMeta) toolContext() ToolContext {
+	return ToolContext{Session: meta.Session, GuildID: meta.GuildID, ChannelID: meta.ChannelID, UserID: meta.UserID}
+}
+
+// interactionUserID returns the ID of the user who triggered the interaction, either in a guild or in a DM.
+func interactionUserID(i *discordgo.InteractionCreate) string {
+	if i.Member != nil && i.Member.User != nil {
+		return i.Member.User.ID
+	}
+	if i.User != nil {
+		return i.User.ID
+	}
+	return ""
+}
+
+// prompt used to let the model keep going from its last reply
+const continuePrompt = "Continue exactly where you left off. Do not repeat what you have already written."
+
 // the functional options for OpenAIChatBot
 type ChatBotOption func(*OpenAIChatBot)
 
@@ -24,87 +166,545 @@ func WithLogger(l Logger) ChatBotOption {
 	}
 }
 
+// functional option to set the sender for OpenAIChatBot
+func WithSender(sender Sender) ChatBotOption {
+	return func(s *OpenAIChatBot) {
+		s.sender = sender
+	}
+}
+
+// functional option to configure the OpenAI client, e.g. to use another base URL or HTTP client.
+// OPENAI_API_KEY and OPENAI_BASE_URL are ignored if this option is given.
+func WithClientConfig(c openai.ClientConfig) ChatBotOption {
+	return func(s *OpenAIChatBot) {
+		s.clientConfig = &c
+	}
+}
+
+// functional option to record reactions on replies to the JSONL file at path.
+// Feedback is not recorded if path is empty.
+func WithFeedbackLog(path string) ChatBotOption {
+	return func(s *OpenAIChatBot) {
+		if path != "" {
+			s.feedback = NewFeedbackLog(path)
+		}
+	}
+}
+
+// functional option to record every chat completion request to an audit log.
+// Auditing is disabled if c.Path is empty.
+func WithAuditLog(c AuditConfig) ChatBotOption {
+	return func(s *OpenAIChatBot) {
+		if c.Path == "" {
+			return
+		}
+		a, err := NewAuditLog(c)
+		if err != nil {
+			s.logger.Fatal("Error opening audit log: ", err)
+		}
+		s.audit = a
+	}
+}
+
+// functional option to expose the tools of the registry to the model
+func WithTools(r *ToolRegistry, c ToolConfig) ChatBotOption {
+	return func(s *OpenAIChatBot) {
+		s.tools = r
+		s.toolConfig = c
+	}
+}
+
+// functional option to add excerpts of the documentation index to prompts in the configured channels.
+// Retrieval is disabled if c.IndexPath is empty.
+func WithRAG(c RAGConfig) ChatBotOption {
+	return func(s *OpenAIChatBot) {
+		if c.IndexPath == "" {
+			return
+		}
+		r, err := NewRAGRetriever(c)
+		if err != nil {
+			s.logger.Fatal("Error loading RAG index: ", err)
+		}
+		s.rag = r
+	}
+}
+
+// functional option to add pinned messages and knowledge channels to the system prompt
+func WithKnowledge(c KnowledgeConfig) ChatBotOption {
+	return func(s *OpenAIChatBot) {
+		if c.Enabled() {
+			s.knowledge = NewKnowledgeBase(c, s.logger)
+		}
+	}
+}
+
+// functional option to set the personas available in the channels.
+// Only the built-in persona is available without this option.
+func WithPersonas(lib *PersonaLibrary) ChatBotOption {
+	return func(s *OpenAIChatBot) {
+		s.personas = lib
+	}
+}
+
 func NewOpenAIChatBot(opts ...ChatBotOption) (IchatBot, error) {
 	cb := &OpenAIChatBot{}
+	// Default logger configuration
+	cb.logger = &DefaultLogger{}
 	for _, opt := range opts {
 		opt(cb)
 	}
-	// Default logger configuration
-	if cb.logger == nil {
-		cb.logger = &DefaultLogger{}
+	if cb.sender == nil {
+		cb.sender = &DefaultSender{
+			logger: cb.logger,
+		}
+	}
+	if cb.usage == nil {
+		u, err := NewUsageStore(UsageConfig{})
+		if err != nil {
+			return nil, err
+		}
+		cb.usage = u
+	}
+	if cb.rateLimitConfig.Enabled() {
+		cb.limits.Store(NewRateLimiter(cb.rateLimitConfig, cb.usage))
 	}
-	cb.sender = &DefaultSender{
-		logger: cb.logger,
+	if cb.personas == nil {
+		lib, err := NewPersonaLibrary("")
+		if err != nil {
+			return nil, err
+		}
+		cb.personas = lib
 	}
 	cb.Init()
 	return cb, nil
 }
 
+// openAIConfigFromEnv returns the client configuration given by OPENAI_API_KEY and OPENAI_BASE_URL
+// and the pool of its keys.
+func openAIConfigFromEnv(logger Logger) (openai.ClientConfig, *KeyPool, error) {
+	keys, err := apiKeysFromEnv()
+	if err != nil {
+		return openai.ClientConfig{}, nil, err
+	}
+	if len(keys) == 0 {
+		return openai.ClientConfig{}, nil, errors.New("OPENAI_API_KEY not found in .env file, environment variable or OPENAI_API_KEY_FILE")
+	}
+	// the pool sets the key of each request
+	config := openai.DefaultConfig("")
+	// OpenAI compatible endpoint
+	if baseURL := os.Getenv("OPENAI_BASE_URL"); baseURL != "" {
+		config.BaseURL = baseURL
+	}
+	pool := NewKeyPool(keys, config.HTTPClient, logger)
+	config.HTTPClient = pool
+	return config, pool, nil
+}
+
 func (bot *OpenAIChatBot) Init() error {
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	if apiKey == "" {
-		bot.logger.Fatal("OPENAI_API_KEY not found in .env file or environment variable")
+	if bot.clientConfig != nil {
+		bot.client = *openai.NewClientWithConfig(*bot.clientConfig)
+	} else if bot.keys == nil {
+		// the pool is kept when reinitializing so that the keys stay benched or disabled
+		config, keys, err := openAIConfigFromEnv(bot.logger)
+		if err != nil {
+			bot.logger.Fatal(err)
+		}
+		bot.keys = keys
+		bot.client = *openai.NewClientWithConfig(config)
 	}
-	bot.client = *openai.NewClient(apiKey)
-	bot.chatContext = make(map[string]openai.ChatCompletionRequest)
+	bot.mu.Lock()
+	bot.chatContext = make(map[string]conversation)
+	bot.mu.Unlock()
 
 	bot.ReplyFunc = bot.Reply
 	bot.InitFunc = bot.Init
+	bot.RegenerateFunc = bot.regenerate
+	bot.ContinueFunc = bot.continueReply
+	bot.RepliedFunc = bot.replied
+	bot.RedactFunc = bot.redactText
+	bot.AskFunc = bot.ask
+	bot.ModelFunc = bot.model
 	bot.logger.Println("Initialized OpenAI chatbot")
 	return nil
 }
 
 func (bot *OpenAIChatBot) Reply(prompt string, s *discordgo.Session, m *discordgo.MessageCreate) (string, error) {
-	if c, exists := bot.chatContext[m.ChannelID]; exists {
-		c.Messages = append(c.Messages, openai.ChatCompletionMessage{
-			Role:    openai.ChatMessageRoleUser,
-			Content: prompt,
-		})
-		bot.chatContext[m.ChannelID] = c
-	} else {
-		c = bot.newContext()
-		c.Messages = append(c.Messages, openai.ChatCompletionMessage{
-			Role:    openai.ChatMessageRoleUser,
-			Content: prompt,
-		})
-		bot.chatContext[m.ChannelID] = c
-	}
-
-	resp, err := bot.client.CreateChatCompletion(context.Background(), bot.chatContext[m.ChannelID])
+	ctx := context.Background()
+	meta := messageMeta("reply", s, m)
+	meta.Status = bot.channelStatus(s, m.ChannelID)
+	if err := bot.allow(meta); err != nil {
+		return "", err
+	}
+	// sensitive data and flagged prompts must not enter the context of the channel
+	prompt = bot.redact(meta, prompt)
+	prompt, err := bot.moderate(ctx, meta, prompt, false)
+	if err != nil {
+		return "", err
+	}
+	msg := openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleUser,
+		Content: prompt,
+	}
+	// the prompt is only kept once it is answered, so that rejected requests are not sent with the next one
+	req, untrusted := bot.channelContext(m.ChannelID, meta.UserID)
+	req.Messages = append(req.Messages, msg)
+	meta.Untrusted = untrusted
+
+	msgs, err := bot.complete(ctx, meta, req)
 	if err != nil {
 		bot.logger.Println("ChatCompletion error: %v\n", err)
 		return "", err
 	}
-	//fmt.Printf("%s\n\n", resp.Choices[0].Message.Content)
-	c := bot.chatContext[m.ChannelID]
-	c.Messages = append(c.Messages, resp.Choices[0].Message)
-	bot.chatContext[m.ChannelID] = c
-	return resp.Choices[0].Message.Content, nil
+	bot.appendMessages(m.ChannelID, meta.UserID, append([]openai.ChatCompletionMessage{msg}, msgs...)...)
+	return msgs[len(msgs)-1].Content, nil
+}
+
+// regenerate replaces the last reply in the context of the channel with a new sample.
+func (bot *OpenAIChatBot) regenerate(s *discordgo.Session, i *discordgo.InteractionCreate) (string, error) {
+	bot.mu.Lock()
+	c, exists := bot.chatContext[i.ChannelID]
+	n := len(c.Messages)
+	if !exists || n == 0 || c.Messages[n-1].Role != openai.ChatMessageRoleAssistant {
+		bot.mu.Unlock()
+		return "", &userFacingError{"There is no reply to regenerate in this channel."}
+	}
+	if !c.isLatestReply(i) {
+		bot.mu.Unlock()
+		return "", &userFacingError{"Only the latest reply in this channel can be regenerated."}
+	}
+	// drop the tool calls of the reply as well
+	start := n
+	for start > 0 && c.Messages[start-1].Role != openai.ChatMessageRoleUser {
+		start--
+	}
+	meta := interactionMeta("regenerate", s, i)
+	meta.Status = bot.channelStatus(s, i.ChannelID)
+	// the prompt of someone else must not be able to use tools on behalf of the user clicking
+	req, untrusted := c.request(start, meta.UserID)
+	meta.Untrusted = untrusted
+	bot.mu.Unlock()
+	if err := bot.allow(meta); err != nil {
+		return "", err
+	}
+
+	msgs, err := bot.complete(context.Background(), meta, req)
+	if err != nil {
+		bot.logger.Println("ChatCompletion error:", err)
+		return "", err
+	}
+
+	// the reply is only replaced if it is still the latest one
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	if c, exists := bot.chatContext[i.ChannelID]; exists && c.isLatestReply(i) && len(c.Messages) == n {
+		bot.chatContext[i.ChannelID] = c.with(start, msgs...)
+	}
+	return msgs[len(msgs)-1].Content, nil
+}
+
+// continueReply asks the model to keep going and merges the continuation into the last reply of the channel.
+func (bot *OpenAIChatBot) continueReply(s *discordgo.Session, i *discordgo.InteractionCreate) (string, error) {
+	bot.mu.Lock()
+	c, exists := bot.chatContext[i.ChannelID]
+	n := len(c.Messages)
+	if !exists || n == 0 || c.Messages[n-1].Role != openai.ChatMessageRoleAssistant {
+		bot.mu.Unlock()
+		return "", &userFacingError{"There is no reply to continue in this channel."}
+	}
+	if !c.isLatestReply(i) {
+		bot.mu.Unlock()
+		return "", &userFacingError{"Only the latest reply in this channel can be continued."}
+	}
+	meta := interactionMeta("continue", s, i)
+	meta.Status = bot.channelStatus(s, i.ChannelID)
+	req, untrusted := c.request(n, meta.UserID)
+	meta.Untrusted = untrusted
+	bot.mu.Unlock()
+	if err := bot.allow(meta); err != nil {
+		return "", err
+	}
+	// the continue instruction is not kept in the context
+	req.Messages = append(req.Messages, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleUser,
+		Content: continuePrompt,
+	})
+
+	msgs, err := bot.complete(context.Background(), meta, req)
+	if err != nil {
+		bot.logger.Println("ChatCompletion error:", err)
+		return "", err
+	}
+	content := msgs[len(msgs)-1].Content
+
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	c, exists = bot.chatContext[i.ChannelID]
+	if exists && c.isLatestReply(i) && len(c.Messages) == n {
+		c = c.with(n)
+		c.Messages[n-1].Content += content
+		bot.chatContext[i.ChannelID] = c
+	}
+	return content, nil
+}
+
+// replied records msg as the message carrying the buttons of the last reply in the channel
+func (bot *OpenAIChatBot) replied(channelID string, msg *discordgo.Message) {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	c, exists := bot.chatContext[channelID]
+	n := len(c.Messages)
+	if !exists || n == 0 || c.Messages[n-1].Role != openai.ChatMessageRoleAssistant {
+		return
+	}
+	c = c.with(n)
+	c.turns[n-1].MessageID = msg.ID
+	bot.chatContext[channelID] = c
+}
+
+// ask answers a single question in a new conversation, leaving the context of the channel untouched.
+func (bot *OpenAIChatBot) ask(question string, s *discordgo.Session, i *discordgo.InteractionCreate) (string, error) {
+	if strings.TrimSpace(question) == "" {
+		return "", &userFacingError{"Please ask a question."}
+	}
+	return bot.completeOnce(context.Background(), interactionMeta("ask", s, i), question)
+}
+
+// completeOnce answers the prompt in a new conversation.
+// No status messages are sent since they would reveal a private request in the channel.
+func (bot *OpenAIChatBot) completeOnce(ctx context.Context, meta requestMeta, prompt string) (string, error) {
+	if err := bot.allow(meta); err != nil {
+		return "", err
+	}
+	prompt, err := bot.moderate(ctx, meta, bot.redact(meta, prompt), false)
+	if err != nil {
+		return "", err
+	}
+	req := bot.newContext()
+	req.Messages = append(req.Messages, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleUser,
+		Content: prompt,
+	})
+	msgs, err := bot.complete(ctx, meta, req)
+	if err != nil {
+		bot.logger.Println("ChatCompletion error:", err)
+		return "", err
+	}
+	return msgs[len(msgs)-1].Content, nil
+}
+
+// complete sends the request and executes the tool calls of the model until it answers.
+// It returns the messages generated on the way, the last one being the moderated answer.
+// The rate limits and quotas must have been checked with allow.
+func (bot *OpenAIChatBot) complete(ctx context.Context, meta requestMeta, req openai.ChatCompletionRequest) ([]openai.ChatCompletionMessage, error) {
+	if bot.tools != nil && bot.tools.Len() > 0 && !meta.Untrusted {
+		req.Tools = bot.tools.Definitions()
+	}
+	req.Messages = append([]openai.ChatCompletionMessage{}, req.Messages...)
+	persona := bot.personas.Active(meta.ChannelID)
+	model, err := bot.requestModel(persona.Model)
+	if err != nil {
+		return nil, err
+	}
+	req.Model = model
+	if persona.Temperature != nil {
+		req.Temperature = *persona.Temperature
+	}
+	// the system prompt is built for every request since the persona and the reference material change over time
+	if len(req.Messages) > 0 && req.Messages[0].Role == openai.ChatMessageRoleSystem {
+		prompt, err := bot.systemPrompt(persona, meta)
+		if err != nil {
+			return nil, err
+		}
+		req.Messages[0].Content = prompt
+	}
+	// retrieved documents are not kept in the context. A continuation uses the ones already in the reply.
+	if bot.rag != nil && meta.Kind != "continue" && bot.rag.config.Enabled(meta.ChannelID) {
+		augmented, err := bot.rag.Augment(ctx, bot.embedder(meta), req)
+		if err != nil {
+			bot.logger.Println("Error retrieving documents:", err)
+		} else {
+			req = augmented
+		}
+	}
+
+	var msgs []openai.ChatCompletionMessage
+	for n := 0; ; n++ {
+		if n >= bot.toolConfig.MaxIterations && req.Tools != nil {
+			// make the model answer with the results so far
+			req.ToolChoice = "none"
+		}
+		resp, err := bot.createChatCompletion(ctx, meta, req)
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Choices) == 0 {
+			return nil, errors.New("chat completion returned no choices")
+		}
+		msg := resp.Choices[0].Message
+		msgs = append(msgs, msg)
+		if len(msg.ToolCalls) == 0 || req.Tools == nil || req.ToolChoice == "none" {
+			content, err := bot.moderate(ctx, meta, msg.Content, true)
+			if err != nil {
+				return nil, err
+			}
+			msgs[len(msgs)-1].Content = content
+			return msgs, nil
+		}
+
+		req.Messages = append(req.Messages, msg)
+		for _, call := range msg.ToolCalls {
+			if meta.Status != nil {
+				meta.Status(fmt.Sprintf("Using tool `%s`…", call.Function.Name))
+			}
+			result := bot.tools.Call(ctx, meta.toolContext(), call, bot.toolConfig.Timeout)
+			// results with content of other people must not be able to make the model call tools on behalf of the user
+			if !bot.tools.Trusted(call.Function.Name) {
+				if err := bot.checkUntrusted(meta, result); err != nil {
+					return nil, err
+				}
+				result = wrapUntrusted(result)
+				req.Tools = nil
+				if !meta.Untrusted && req.Messages[0].Role == openai.ChatMessageRoleSystem {
+					req.Messages[0].Content += "\n\n" + untrustedNotice
+				}
+				meta.Untrusted = true
+			}
+			toolMsg := openai.ChatCompletionMessage{
+				Role:       openai.ChatMessageRoleTool,
+				Content:    result,
+				ToolCallID: call.ID,
+			}
+			req.Messages = append(req.Messages, toolMsg)
+			msgs = append(msgs, toolMsg)
+		}
+	}
+}
+
+// allow checks the rate limits and quotas. It is called once per command before anything is sent to the API, moderation included.
+func (bot *OpenAIChatBot) allow(meta requestMeta) error {
+	limits := bot.limits.Load()
+	if limits == nil {
+		return nil
+	}
+	err := limits.Allow(meta)
+	if err != nil {
+		bot.logger.Println("Rate limited:", meta.GuildID, meta.ChannelID, meta.UserID, err)
+	}
+	return err
+}
+
+// requestModel returns the model to request instead of model, which differs when the budget is used up
+func (bot *OpenAIChatBot) requestModel(model string) (string, error) {
+	budget := bot.budget.Load()
+	if budget == nil {
+		return model, nil
+	}
+	return budget.Model(model)
+}
+
+// channelStatus returns a status function posting to the channel.
+func (bot *OpenAIChatBot) channelStatus(s *discordgo.Session, channelID string) func(string) {
+	return func(text string) {
+		bot.sender.ChannelSend(s, channelID, text)
+	}
+}
+
+// createChatCompletion sends the request to the API and records it in the usage and audit logs.
+func (bot *OpenAIChatBot) createChatCompletion(ctx context.Context, meta requestMeta, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	req = bot.redactRequest(req)
+	start := time.Now()
+	resp, err := bot.client.CreateChatCompletion(ctx, req)
+	if err == nil {
+		bot.recordUsage(meta, req.Model, resp.Usage)
+	}
+	if bot.audit != nil {
+		if auditErr := bot.audit.Record(meta, req, resp, err, time.Since(start)); auditErr != nil {
+			bot.logger.Println("Error writing audit log:", auditErr)
+		}
+	}
+	return resp, err
+}
+
+// systemPrompt returns the system prompt of the persona for the request including the reference material of the channel.
+func (bot *OpenAIChatBot) systemPrompt(persona *Persona, meta requestMeta) (string, error) {
+	prompt, err := bot.renderPersona(persona, meta)
+	if err != nil {
+		return "", err
+	}
+	if meta.Untrusted {
+		prompt += "\n\n" + untrustedNotice
+	}
+	if bot.knowledge != nil && meta.Session != nil {
+		// pins and notes are written by members, so they are redacted like prompts
+		if ref := bot.redactText(bot.knowledge.Reference(meta.Session, meta.GuildID, meta.ChannelID)); ref != "" {
+			prompt += "\n\nUse the following reference material maintained by the moderators. " +
+				"It takes precedence over your own knowledge.\n\n" + ref
+		}
+	}
+	return prompt, nil
+}
+
+// embedder returns an embedder using the client of the bot which accounts the usage to the request.
+func (bot *OpenAIChatBot) embedder(meta requestMeta) embedder {
+	meta.Kind = "embedding"
+	return clientEmbedder(&bot.client, func(model string, u openai.Usage) {
+		bot.recordUsage(meta, model, u)
+	})
+}
+
+// channelContext returns the context of the channel for a request of the user and whether it has prompts of other users
+func (bot *OpenAIChatBot) channelContext(channelID, userID string) (openai.ChatCompletionRequest, bool) {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	c, exists := bot.chatContext[channelID]
+	if !exists {
+		return bot.newContext(), false
+	}
+	return c.request(len(c.Messages), userID)
+}
+
+// appendMessages appends the messages to the context of the channel and returns a copy of the updated context.
+// authorID is the user who wrote the first message, if it is a prompt.
+func (bot *OpenAIChatBot) appendMessages(channelID, authorID string, msgs ...openai.ChatCompletionMessage) openai.ChatCompletionRequest {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	c, exists := bot.chatContext[channelID]
+	if !exists {
+		c = conversation{ChatCompletionRequest: bot.newContext()}
+		c.turns = make([]turn, len(c.Messages))
+	}
+	n := len(c.Messages)
+	c = c.with(n, msgs...)
+	if len(msgs) > 0 {
+		c.turns[n].AuthorID = authorID
+	}
+	bot.chatContext[channelID] = c
+	return c.ChatCompletionRequest
 }
 
-func (bot *OpenAIChatBot) FakeReply(prompt string) (string, error) {
-	f, _ := os.Open("fake.txt")
-	data := make([]byte, 4096)
-	count, _ := f.Read(data)
-	return string(data[:count]), nil
+// model returns the model used in the channel
+func (bot *OpenAIChatBot) model(channelID string) string {
+	return bot.personas.Active(channelID).Model
 }
 
 func (bot *OpenAIChatBot) newContext() openai.ChatCompletionRequest {
 	return openai.ChatCompletionRequest{
-		Model: "gpt-5.2",
+		Model: defaultModel,
 		Messages: []openai.ChatCompletionMessage{
 			{
 				Role:    openai.ChatMessageRoleSystem,
-				Content: "you are a helpful chatbot",
+				Content: defaultSystemPrompt,
 			},
 		},
 	}
 }
 
 func (bot *OpenAIChatBot) RemoveContext(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	bot.mu.Lock()
 	if _, exists := bot.chatContext[i.ChannelID]; exists {
 		delete(bot.chatContext, i.ChannelID)
 	}
+	bot.mu.Unlock()
 	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{
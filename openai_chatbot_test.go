@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/ewohltman/discordgo-mock/mockconstants"
+	"github.com/ewohltman/discordgo-mock/mockuser"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func mentionMessage(content string) *discordgo.MessageCreate {
+	return &discordgo.MessageCreate{
+		Message: &discordgo.Message{
+			ID:        "dummy_message_id",
+			Content:   "<@123> " + content,
+			ChannelID: mockconstants.TestChannel,
+			GuildID:   mockconstants.TestGuild,
+			Author: &discordgo.User{
+				ID:       mockconstants.TestUser,
+				Username: "Test user",
+			},
+			Mentions: []*discordgo.User{
+				mockuser.New(
+					mockuser.WithID("123"),
+					mockuser.WithBotFlag(true),
+				),
+			},
+		},
+	}
+}
+
+func componentInteraction(customID string) *discordgo.InteractionCreate {
+	return &discordgo.InteractionCreate{
+		Interaction: &discordgo.Interaction{
+			Type:      discordgo.InteractionMessageComponent,
+			ChannelID: mockconstants.TestChannel,
+			GuildID:   mockconstants.TestGuild,
+			Member:    &discordgo.Member{User: &discordgo.User{ID: mockconstants.TestUser}},
+			Data:      discordgo.MessageComponentInteractionData{CustomID: customID},
+		},
+	}
+}
+
+func commandInteraction(name string, options ...*discordgo.ApplicationCommandInteractionDataOption) *discordgo.InteractionCreate {
+	return &discordgo.InteractionCreate{
+		Interaction: &discordgo.Interaction{
+			ID:        "dummy_interaction_id",
+			Token:     "dummy_token",
+			Type:      discordgo.InteractionApplicationCommand,
+			ChannelID: mockconstants.TestChannel,
+			GuildID:   mockconstants.TestGuild,
+			Member:    &discordgo.Member{User: &discordgo.User{ID: mockconstants.TestUser}},
+			Data:      discordgo.ApplicationCommandInteractionData{Name: name, Options: options},
+		},
+	}
+}
+
+func stringOption(name, value string) *discordgo.ApplicationCommandInteractionDataOption {
+	return &discordgo.ApplicationCommandInteractionDataOption{
+		Name:  name,
+		Type:  discordgo.ApplicationCommandOptionString,
+		Value: value,
+	}
+}
+
+func boolOption(name string, value bool) *discordgo.ApplicationCommandInteractionDataOption {
+	return &discordgo.ApplicationCommandInteractionDataOption{
+		Name:  name,
+		Type:  discordgo.ApplicationCommandOptionBoolean,
+		Value: value,
+	}
+}
+
+// interactionRecorder captures the interaction responses sent through the session, which discordgo-mock does not handle.
+type interactionRecorder struct {
+	next http.RoundTripper
+
+	mu        sync.Mutex
+	responses []discordgo.InteractionResponse
+}
+
+func recordInteractions(s *discordgo.Session) *interactionRecorder {
+	r := &interactionRecorder{next: s.Client.Transport}
+	s.Client.Transport = r
+	return r
+}
+
+func (r *interactionRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.Contains(req.URL.Path, "/interactions/") {
+		return r.next.RoundTrip(req)
+	}
+	var resp discordgo.InteractionResponse
+	if err := json.NewDecoder(req.Body).Decode(&resp); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.responses = append(r.responses, resp)
+	r.mu.Unlock()
+	return &http.Response{StatusCode: http.StatusNoContent, Body: http.NoBody, Header: http.Header{}, Request: req}, nil
+}
+
+// Responses returns the contents of the interaction responses so far
+func (r *interactionRecorder) Responses() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var contents []string
+	for _, resp := range r.responses {
+		if resp.Data != nil {
+			contents = append(contents, resp.Data.Content)
+		} else {
+			contents = append(contents, "")
+		}
+	}
+	return contents
+}
+
+func TestReplyEndToEnd(t *testing.T) {
+	fake := newFakeOpenAI(t, fakeResponse{Content: "Hi!"}, fakeResponse{Content: "Fine."})
+	bot, sender := newTestOpenAIChatBot(t, fake)
+	s := newSession()
+
+	bot.HandleReply(s, mentionMessage("hello"))
+	bot.HandleReply(s, mentionMessage("how are you?"))
+
+	got := sender.Messages[mockconstants.TestChannel]
+	if strings.Join(got, "|") != "Hi!\n|Fine.\n" {
+		t.Errorf("unexpected messages %#v", got)
+	}
+	reqs := fake.Requests()
+	if len(reqs) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(reqs))
+	}
+	// the second request carries the conversation so far
+	var roles []string
+	for _, m := range reqs[1].Messages {
+		roles = append(roles, m.Role+":"+strings.TrimSpace(m.Content))
+	}
+	expected := "system:you are a helpful chatbot|user:hello|assistant:Hi!|user:how are you?"
+	if strings.Join(roles, "|") != expected {
+		t.Errorf("expected messages %v, got %v", expected, strings.Join(roles, "|"))
+	}
+}
+
+func TestHandleReplyAPIError(t *testing.T) {
+	fake := newFakeOpenAI(t, fakeResponse{Status: 429, ErrorMessage: "Rate limit reached"})
+	bot, sender := newTestOpenAIChatBot(t, fake)
+
+	bot.HandleReply(newSession(), mentionMessage("hello"))
+
+	got := sender.Messages[mockconstants.TestChannel]
+	if len(got) != 1 || got[0] != "Rate limit reached" {
+		t.Errorf("expected the API error to be reported, got %#v", got)
+	}
+}
+
+func TestRegenerateAndContinue(t *testing.T) {
+	fake := newFakeOpenAI(t,
+		fakeResponse{Content: "first"},
+		fakeResponse{Content: "second", FinishReason: openai.FinishReasonLength},
+		fakeResponse{Content: " and more"},
+	)
+	bot, _ := newTestOpenAIChatBot(t, fake)
+	s := newSession()
+
+	if _, err := bot.continueReply(s, componentInteraction(ComponentContinue)); err == nil {
+		t.Error("expected an error when there is nothing to continue")
+	}
+	if _, err := bot.Reply("hello", s, mentionMessage("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := bot.regenerate(s, componentInteraction(ComponentRegenerate)); err != nil || reply != "second" {
+		t.Fatalf("regenerate = %q, %v", reply, err)
+	}
+	if reply, err := bot.continueReply(s, componentInteraction(ComponentContinue)); err != nil || reply != " and more" {
+		t.Fatalf("continue = %q, %v", reply, err)
+	}
+
+	reqs := fake.Requests()
+	if n := len(reqs[1].Messages); reqs[1].Messages[n-1].Content != "hello" {
+		t.Errorf("regenerate should drop the last reply, got %#v", reqs[1].Messages)
+	}
+	if n := len(reqs[2].Messages); reqs[2].Messages[n-1].Content != continuePrompt {
+		t.Errorf("continue should ask to continue, got %#v", reqs[2].Messages)
+	}
+	c := bot.chatContext[mockconstants.TestChannel]
+	if last := c.Messages[len(c.Messages)-1]; last.Content != "second and more" || len(c.Messages) != 3 {
+		t.Errorf("expected the continuation to be merged into the last reply, got %#v", c.Messages)
+	}
+}
+
+func TestRegenerateOlderReply(t *testing.T) {
+	fake := newFakeOpenAI(t, fakeResponse{Content: "one"}, fakeResponse{Content: "two"}, fakeResponse{Content: "two again"})
+	bot, sender := newTestOpenAIChatBot(t, fake)
+	s := newSession()
+	recordInteractions(s)
+	clickOn := func(customID, messageID string) *discordgo.InteractionCreate {
+		i := componentInteraction(customID)
+		i.Message = &discordgo.Message{ID: messageID, ChannelID: mockconstants.TestChannel}
+		return i
+	}
+
+	bot.HandleReply(s, mentionMessage("first"))
+	bot.HandleReply(s, mentionMessage("second"))
+	bot.Regenerate(s, clickOn(ComponentRegenerate, "reply-1"))
+	bot.Continue(s, clickOn(ComponentContinue, "reply-1"))
+	bot.Regenerate(s, clickOn(ComponentRegenerate, "reply-2"))
+	bot.Continue(s, clickOn(ComponentContinue, "reply-2"))
+
+	expected := []string{
+		"one",
+		"two",
+		"Only the latest reply in this channel can be regenerated.",
+		"Only the latest reply in this channel can be continued.",
+		"two again",
+		"Only the latest reply in this channel can be continued.",
+	}
+	got := sender.Messages[mockconstants.TestChannel]
+	if len(got) != len(expected) {
+		t.Fatalf("expected messages %#v, got %#v", expected, got)
+	}
+	for n := range expected {
+		if strings.TrimSpace(got[n]) != expected[n] {
+			t.Errorf("message %d: expected %q, got %q", n, expected[n], got[n])
+		}
+	}
+	if len(fake.Requests()) != 3 {
+		t.Errorf("expected older replies not to be sent to the model, got %d requests", len(fake.Requests()))
+	}
+	c := bot.chatContext[mockconstants.TestChannel]
+	if n := len(c.Messages); n != 5 || c.Messages[n-1].Content != "two again" || c.turns[n-1].MessageID != "reply-3" {
+		t.Errorf("expected the latest reply to be replaced, got %#v %#v", c.Messages, c.turns)
+	}
+}
+
+func TestFakeOpenAIStream(t *testing.T) {
+	fake := newFakeOpenAI(t, fakeResponse{Chunks: []string{"Hel", "lo", "!"}})
+	client := openai.NewClientWithConfig(fake.Config())
+
+	stream, err := client.CreateChatCompletionStream(context.Background(), openai.ChatCompletionRequest{
+		Model:    "test-model",
+		Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hi"}},
+		Stream:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	var sb strings.Builder
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		sb.WriteString(resp.Choices[0].Delta.Content)
+	}
+	if sb.String() != "Hello!" {
+		t.Errorf("expected the chunks to be concatenated, got %q", sb.String())
+	}
+}
+
+func TestFakeOpenAILatency(t *testing.T) {
+	fake := newFakeOpenAI(t, fakeResponse{Content: "late", Latency: time.Second})
+	bot, _ := newTestOpenAIChatBot(t, fake)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := bot.createChatCompletion(ctx, requestMeta{Kind: "test"}, bot.newContext())
+	if got := errorClass(err); got != "timeout" {
+		t.Errorf("expected a timeout, got %v (%v)", got, err)
+	}
+}
+
+func TestAsk(t *testing.T) {
+	tests := []struct {
+		name      string
+		options   []*discordgo.ApplicationCommandInteractionDataOption
+		responses []fakeResponse
+		expected  string
+		flags     discordgo.MessageFlags
+	}{
+		{"Public", []*discordgo.ApplicationCommandInteractionDataOption{stringOption("question", "2+2?")},
+			[]fakeResponse{{Content: "4"}}, "4", 0},
+		{"Private", []*discordgo.ApplicationCommandInteractionDataOption{stringOption("question", "2+2?"), boolOption("private", true)},
+			[]fakeResponse{{Content: "4"}}, "4", discordgo.MessageFlagsEphemeral},
+		{"APIError", []*discordgo.ApplicationCommandInteractionDataOption{stringOption("question", "2+2?"), boolOption("private", true)},
+			[]fakeResponse{{Status: 500, ErrorMessage: "server error"}}, "server error", discordgo.MessageFlagsEphemeral},
+		{"Empty", []*discordgo.ApplicationCommandInteractionDataOption{stringOption("question", " ")},
+			nil, "Please ask a question.", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeOpenAI(t, test.responses...)
+			bot, sender := newTestOpenAIChatBot(t, fake)
+			s := newSession()
+			recorder := recordInteractions(s)
+			bot.appendMessages(mockconstants.TestChannel, mockconstants.TestUser, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: "earlier"})
+
+			bot.Ask(s, commandInteraction("ask", test.options...))
+
+			if len(recorder.responses) != 1 || recorder.responses[0].Type != discordgo.InteractionResponseDeferredChannelMessageWithSource ||
+				recorder.responses[0].Data.Flags != test.flags {
+				t.Errorf("expected a deferred response with flags %v, got %#v", test.flags, recorder.responses)
+			}
+			if len(sender.Followups) != 1 || strings.TrimSpace(sender.Followups[0].Content) != test.expected || sender.Followups[0].Flags != test.flags {
+				t.Errorf("expected followup %q, got %#v", test.expected, sender.Followups)
+			}
+			if len(sender.Messages) != 0 {
+				t.Errorf("expected nothing posted to the channel, got %#v", sender.Messages)
+			}
+			for _, req := range fake.Requests() {
+				if len(req.Messages) != 2 {
+					t.Errorf("expected a conversation of the question only, got %#v", req.Messages)
+				}
+			}
+			if c := bot.chatContext[mockconstants.TestChannel]; len(c.Messages) != 2 {
+				t.Errorf("expected the context of the channel to be untouched, got %#v", c.Messages)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// features which can be restricted to members with permissions or roles.
+// /persona changes both the model and the system prompt of a channel.
+const (
+	FeatureForget  = "forget"
+	FeaturePersona = "persona"
+	FeatureUsage   = "usage"
+)
+
+// features of the slash commands
+var commandFeatures = map[string]string{
+	"forget":  FeatureForget,
+	"persona": FeaturePersona,
+	"usage":   FeatureUsage,
+}
+
+// features of the buttons attached to bot replies
+var componentFeatures = map[string]string{
+	ComponentForget: FeatureForget,
+}
+
+// names of the permissions accepted in the configuration
+var permissionNames = map[string]int64{
+	"administrator":    discordgo.PermissionAdministrator,
+	"manage_guild":     discordgo.PermissionManageGuild,
+	"manage_channels":  discordgo.PermissionManageChannels,
+	"manage_messages":  discordgo.PermissionManageMessages,
+	"manage_roles":     discordgo.PermissionManageRoles,
+	"manage_threads":   discordgo.PermissionManageThreads,
+	"moderate_members": discordgo.PermissionModerateMembers,
+	"kick_members":     discordgo.PermissionKickMembers,
+	"ban_members":      discordgo.PermissionBanMembers,
+}
+
+// FeaturePermission is who may use a feature
+type FeaturePermission struct {
+	// Discord permissions a member needs all of, 0 for everyone
+	Permissions int64
+	// roles allowed to use the feature without the permissions
+	Roles []string
+}
+
+// PermissionConfig maps features to who may use them.
+// Features without an entry may be used by everyone.
+type PermissionConfig map[string]FeaturePermission
+
+// permissions used unless configured otherwise
+var defaultPermissions = PermissionConfig{
+	FeatureForget:  {Permissions: discordgo.PermissionManageMessages},
+	FeaturePersona: {Permissions: discordgo.PermissionManageChannels},
+	FeatureUsage:   {Permissions: discordgo.PermissionManageGuild},
+}
+
+func permissionConfigFromEnv() (PermissionConfig, error) {
+	c := make(PermissionConfig)
+	for feature, def := range defaultPermissions {
+		name := "PERMISSIONS_" + strings.ToUpper(feature)
+		p := def
+		if v := os.Getenv(name); v != "" {
+			var err error
+			if p.Permissions, err = parsePermissions(v); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		p.Roles = envList(name + "_ROLES")
+		c[feature] = p
+	}
+	return c, nil
+}
+
+// parsePermissions parses comma separated permission names, or "everyone" for no permissions
+func parsePermissions(v string) (int64, error) {
+	if strings.TrimSpace(v) == "everyone" {
+		return 0, nil
+	}
+	var perms int64
+	for _, name := range strings.Split(v, ",") {
+		p, ok := permissionNames[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return 0, fmt.Errorf("unknown permission %q", name)
+		}
+		perms |= p
+	}
+	return perms, nil
+}
+
+// Allowed reports whether the member may use the feature.
+// member is nil in DMs, where everyone may use every feature.
+func (c PermissionConfig) Allowed(feature string, member *discordgo.Member) bool {
+	p, ok := c[feature]
+	if !ok || p.Permissions == 0 || member == nil {
+		return true
+	}
+	if member.Permissions&discordgo.PermissionAdministrator != 0 || member.Permissions&p.Permissions == p.Permissions {
+		return true
+	}
+	for _, r := range member.Roles {
+		if slices.Contains(p.Roles, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetDefaultPermissions sets the default member permissions of the commands so that
+// Discord hides them from members who may not use them.
+// Commands whose feature is allowed to roles stay visible as the roles may lack the permissions.
+func (c PermissionConfig) SetDefaultPermissions(cmds []*discordgo.ApplicationCommand) {
+	for _, cmd := range cmds {
+		if cmd.Type != 0 && cmd.Type != discordgo.ChatApplicationCommand {
+			continue
+		}
+		p, ok := c[commandFeatures[cmd.Name]]
+		if !ok || p.Permissions == 0 || len(p.Roles) > 0 {
+			continue
+		}
+		perms := p.Permissions
+		cmd.DefaultMemberPermissions = &perms
+	}
+}
+
+// interactionFeature returns the feature used by the interaction, or "" if it is not restricted
+func interactionFeature(i *discordgo.InteractionCreate) string {
+	switch i.Type {
+	case discordgo.InteractionApplicationCommand:
+		if data := i.ApplicationCommandData(); data.CommandType == 0 || data.CommandType == discordgo.ChatApplicationCommand {
+			return commandFeatures[data.Name]
+		}
+	case discordgo.InteractionMessageComponent:
+		return componentFeatures[i.MessageComponentData().CustomID]
+	}
+	return ""
+}
+
+// functional option to restrict features to members with permissions or roles
+func WithPermissions(c PermissionConfig) ChatBotOption {
+	return func(s *OpenAIChatBot) {
+		s.permissions.Store(&c)
+	}
+}
+
+// permissionConfig returns the current permissions, nil if everyone may use every feature
+func (bot *BaseChatBot) permissionConfig() PermissionConfig {
+	if c := bot.permissions.Load(); c != nil {
+		return *c
+	}
+	return nil
+}
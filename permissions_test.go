@@ -0,0 +1,128 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestPermissionConfigFromEnv(t *testing.T) {
+	t.Setenv("PERMISSIONS_FORGET", "everyone")
+	t.Setenv("PERMISSIONS_PERSONA", "manage_guild, Manage_Channels")
+	t.Setenv("PERMISSIONS_PERSONA_ROLES", "prompt-engineers")
+	t.Setenv("PERMISSIONS_USAGE", "")
+	c, err := permissionConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c[FeatureForget].Permissions != 0 {
+		t.Errorf("expected everyone to forget, got %d", c[FeatureForget].Permissions)
+	}
+	if p := c[FeaturePersona]; p.Permissions != discordgo.PermissionManageGuild|discordgo.PermissionManageChannels || !slices.Equal(p.Roles, []string{"prompt-engineers"}) {
+		t.Errorf("unexpected persona permission %+v", p)
+	}
+	if p := c[FeatureUsage]; p.Permissions != discordgo.PermissionManageGuild || len(p.Roles) != 0 {
+		t.Errorf("expected the default usage permission, got %+v", c[FeatureUsage])
+	}
+
+	t.Setenv("PERMISSIONS_FORGET", "manage_everything")
+	if _, err := permissionConfigFromEnv(); err == nil {
+		t.Error("expected an unknown permission to be rejected")
+	}
+}
+
+func TestPermissionAllowed(t *testing.T) {
+	c := PermissionConfig{
+		FeatureForget:  {Permissions: discordgo.PermissionManageMessages, Roles: []string{"mods"}},
+		FeaturePersona: {Permissions: discordgo.PermissionManageChannels | discordgo.PermissionManageGuild},
+		FeatureUsage:   {},
+	}
+	tests := []struct {
+		name    string
+		feature string
+		member  *discordgo.Member
+		want    bool
+	}{
+		{"Permission", FeatureForget, &discordgo.Member{Permissions: discordgo.PermissionManageMessages}, true},
+		{"NoPermission", FeatureForget, &discordgo.Member{Permissions: discordgo.PermissionSendMessages}, false},
+		{"Role", FeatureForget, &discordgo.Member{Roles: []string{"mods"}}, true},
+		{"Administrator", FeatureForget, &discordgo.Member{Permissions: discordgo.PermissionAdministrator}, true},
+		{"DM", FeatureForget, nil, true},
+		{"AllPermissionsNeeded", FeaturePersona, &discordgo.Member{Permissions: discordgo.PermissionManageChannels}, false},
+		{"AllPermissions", FeaturePersona, &discordgo.Member{Permissions: discordgo.PermissionManageChannels | discordgo.PermissionManageGuild}, true},
+		{"Everyone", FeatureUsage, &discordgo.Member{}, true},
+		{"Unrestricted", "", &discordgo.Member{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := c.Allowed(test.feature, test.member); got != test.want {
+				t.Errorf("expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestSetDefaultPermissions(t *testing.T) {
+	forget := &discordgo.ApplicationCommand{Name: "forget"}
+	persona := &discordgo.ApplicationCommand{Name: "persona"}
+	ask := &discordgo.ApplicationCommand{Name: "ask"}
+	c := PermissionConfig{
+		FeatureForget:  {Permissions: discordgo.PermissionManageMessages},
+		FeaturePersona: {Permissions: discordgo.PermissionManageChannels, Roles: []string{"prompt-engineers"}},
+	}
+	c.SetDefaultPermissions([]*discordgo.ApplicationCommand{forget, persona, ask})
+
+	if forget.DefaultMemberPermissions == nil || *forget.DefaultMemberPermissions != discordgo.PermissionManageMessages {
+		t.Errorf("expected /forget to need Manage Messages, got %v", forget.DefaultMemberPermissions)
+	}
+	if persona.DefaultMemberPermissions != nil {
+		t.Error("expected /persona to stay visible to its roles")
+	}
+	if ask.DefaultMemberPermissions != nil {
+		t.Error("expected /ask to be visible to everyone")
+	}
+}
+
+func TestAllowInteractionPermissions(t *testing.T) {
+	config := PermissionConfig{FeatureForget: {Permissions: discordgo.PermissionManageMessages}}
+	forgetButton := func(perms int64) *discordgo.InteractionCreate {
+		i := commandInteraction("")
+		i.Type = discordgo.InteractionMessageComponent
+		i.Data = discordgo.MessageComponentInteractionData{CustomID: ComponentForget}
+		i.Member.Permissions = perms
+		return i
+	}
+	withPerms := func(i *discordgo.InteractionCreate, perms int64) *discordgo.InteractionCreate {
+		i.Member.Permissions = perms
+		return i
+	}
+	tests := []struct {
+		name        string
+		interaction *discordgo.InteractionCreate
+		want        bool
+	}{
+		{"ForgetCommand", withPerms(commandInteraction("forget"), discordgo.PermissionManageMessages), true},
+		{"ForgetCommandDenied", withPerms(commandInteraction("forget"), 0), false},
+		{"ForgetButtonDenied", forgetButton(0), false},
+		{"Ask", withPerms(commandInteraction("ask"), 0), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bot, _ := newTestOpenAIChatBot(t, newFakeOpenAI(t), WithPermissions(config))
+			s := newSession()
+			rec := recordInteractions(s)
+
+			if got := bot.AllowInteraction(s, test.interaction); got != test.want {
+				t.Errorf("expected %v, got %v", test.want, got)
+			}
+			var want []string
+			if !test.want {
+				want = []string{"You do not have permission to do this."}
+			}
+			if got := rec.Responses(); !slices.Equal(got, want) {
+				t.Errorf("expected responses %#v, got %#v", want, got)
+			}
+		})
+	}
+}
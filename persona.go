@@ -0,0 +1,333 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"gopkg.in/yaml.v3"
+)
+
+// name of the built-in persona used when no other one is configured
+const defaultPersonaName = "default"
+
+// maximum number of choices of a slash command option
+const maxCommandChoices = 25
+
+// Persona is a named system prompt with the model settings used with it.
+type Persona struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	// model used for replies, the default model if empty
+	Model string `yaml:"model"`
+	// sampling temperature, the API default if nil
+	Temperature *float32 `yaml:"temperature"`
+	// text/template of the system prompt executed with PromptData
+	SystemPrompt string `yaml:"system_prompt"`
+
+	tmpl *template.Template
+}
+
+// PromptData holds the variables available in the system prompt template of a persona.
+type PromptData struct {
+	GuildName    string
+	ChannelName  string
+	ChannelTopic string
+	UserName     string
+	// current date as YYYY-MM-DD
+	Date string
+}
+
+func defaultPersona() *Persona {
+	return &Persona{
+		Name:         defaultPersonaName,
+		Description:  "General purpose assistant",
+		Model:        defaultModel,
+		SystemPrompt: defaultSystemPrompt,
+	}
+}
+
+// parse validates the persona and compiles its template
+func (p *Persona) parse() error {
+	if p.Name == "" {
+		return errors.New("name is required")
+	}
+	if strings.TrimSpace(p.SystemPrompt) == "" {
+		return fmt.Errorf("persona %q: system_prompt is required", p.Name)
+	}
+	if p.Temperature != nil && (*p.Temperature < 0 || *p.Temperature > 2) {
+		return fmt.Errorf("persona %q: temperature must be between 0 and 2", p.Name)
+	}
+	if p.Model == "" {
+		p.Model = defaultModel
+	}
+	tmpl, err := template.New(p.Name).Option("missingkey=error").Parse(p.SystemPrompt)
+	if err != nil {
+		return fmt.Errorf("persona %q: %w", p.Name, err)
+	}
+	p.tmpl = tmpl
+	return nil
+}
+
+// Render executes the system prompt template of the persona.
+func (p *Persona) Render(data PromptData) (string, error) {
+	var sb strings.Builder
+	if err := p.tmpl.Execute(&sb, data); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// PersonaLibrary holds the available personas and the one active in each channel.
+type PersonaLibrary struct {
+	personas map[string]*Persona
+	// persona of the channels without one set
+	defaultName string
+
+	mu     sync.Mutex
+	active map[string]string
+}
+
+// NewPersonaLibrary returns a library of the built-in persona and the given ones.
+// A persona named "default" replaces the built-in one.
+func NewPersonaLibrary(defaultName string, personas ...*Persona) (*PersonaLibrary, error) {
+	lib := &PersonaLibrary{
+		personas:    make(map[string]*Persona),
+		defaultName: defaultName,
+		active:      make(map[string]string),
+	}
+	if lib.defaultName == "" {
+		lib.defaultName = defaultPersonaName
+	}
+	for _, p := range append([]*Persona{defaultPersona()}, personas...) {
+		if err := p.parse(); err != nil {
+			return nil, err
+		}
+		lib.personas[p.Name] = p
+	}
+	if _, ok := lib.personas[lib.defaultName]; !ok {
+		return nil, fmt.Errorf("default persona %q is not defined", lib.defaultName)
+	}
+	return lib, nil
+}
+
+// personaLibraryFromEnv loads the personas of the YAML files in PERSONAS_DIR.
+// PERSONA_DEFAULT names the persona of channels without one set and
+// DEFAULT_MODEL is the model of the personas which do not set one.
+func personaLibraryFromEnv() (*PersonaLibrary, error) {
+	var personas []*Persona
+	if dir := os.Getenv("PERSONAS_DIR"); dir != "" {
+		var err error
+		if personas, err = loadPersonas(dir); err != nil {
+			return nil, err
+		}
+	}
+	if model := os.Getenv("DEFAULT_MODEL"); model != "" {
+		for _, p := range personas {
+			if p.Model == "" {
+				p.Model = model
+			}
+		}
+		builtin := defaultPersona()
+		builtin.Model = model
+		personas = append([]*Persona{builtin}, personas...)
+	}
+	return NewPersonaLibrary(os.Getenv("PERSONA_DEFAULT"), personas...)
+}
+
+// loadPersonas reads one persona from each .yaml or .yml file in dir.
+func loadPersonas(dir string) ([]*Persona, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var personas []*Persona
+	seen := make(map[string]string)
+	for _, e := range entries {
+		ext := strings.ToLower(filepath.Ext(e.Name()))
+		if e.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		p := &Persona{}
+		if err := yaml.Unmarshal(b, p); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if prev, ok := seen[p.Name]; ok {
+			return nil, fmt.Errorf("%s: persona %q is already defined in %s", path, p.Name, prev)
+		}
+		seen[p.Name] = path
+		personas = append(personas, p)
+	}
+	return personas, nil
+}
+
+// Names returns the names of the personas in alphabetical order
+func (lib *PersonaLibrary) Names() []string {
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	var names []string
+	for name := range lib.personas {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (lib *PersonaLibrary) Get(name string) (*Persona, bool) {
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	p, ok := lib.personas[name]
+	return p, ok
+}
+
+// Active returns the persona used in the channel
+func (lib *PersonaLibrary) Active(channelID string) *Persona {
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	if p, ok := lib.personas[lib.active[channelID]]; ok {
+		return p
+	}
+	return lib.personas[lib.defaultName]
+}
+
+// SetActive switches the persona of the channel
+func (lib *PersonaLibrary) SetActive(channelID, name string) {
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	lib.active[channelID] = name
+}
+
+// Replace switches to the personas of another library, keeping the personas active in the channels.
+// Channels whose persona was removed fall back to the default one.
+func (lib *PersonaLibrary) Replace(other *PersonaLibrary) {
+	other.mu.Lock()
+	personas, defaultName := other.personas, other.defaultName
+	other.mu.Unlock()
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	lib.personas, lib.defaultName = personas, defaultName
+}
+
+// personaCommand returns the /persona command offering the personas of the library.
+func personaCommand(lib *PersonaLibrary) *discordgo.ApplicationCommand {
+	option := &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionString,
+		Name:        "name",
+		Description: "persona to use in this channel. Shows the available personas if omitted.",
+	}
+	if names := lib.Names(); len(names) <= maxCommandChoices {
+		for _, name := range names {
+			option.Choices = append(option.Choices, &discordgo.ApplicationCommandOptionChoice{Name: name, Value: name})
+		}
+	}
+	return &discordgo.ApplicationCommand{
+		Name:        "persona",
+		Description: "switch the persona of the bot in this channel",
+		Options:     []*discordgo.ApplicationCommandOption{option},
+	}
+}
+
+// promptData collects the template variables for the request.
+// Names that cannot be resolved are left empty.
+func (bot *OpenAIChatBot) promptData(meta requestMeta) PromptData {
+	data := PromptData{UserName: meta.UserName, Date: time.Now().Format(time.DateOnly)}
+	s := meta.Session
+	if s == nil {
+		return data
+	}
+	// sessions without a client, such as the one of a replay, can only use the state
+	rest := s.Client != nil && s.Ratelimiter != nil
+	if meta.GuildID != "" {
+		g, err := s.State.Guild(meta.GuildID)
+		if err != nil && rest {
+			if g, err = s.Guild(meta.GuildID); err != nil {
+				bot.logger.Println("Error fetching guild for the system prompt:", err)
+			}
+		}
+		if err == nil {
+			data.GuildName = g.Name
+		}
+	}
+	ch, err := s.State.Channel(meta.ChannelID)
+	if err != nil && rest {
+		if ch, err = s.Channel(meta.ChannelID); err != nil {
+			bot.logger.Println("Error fetching channel for the system prompt:", err)
+		}
+	}
+	if err == nil {
+		data.ChannelName = ch.Name
+		data.ChannelTopic = ch.Topic
+	}
+	return data
+}
+
+// renderPersona renders the system prompt of the persona for the request.
+// Template errors are returned as a userFacingError so that they show up in Discord.
+func (bot *OpenAIChatBot) renderPersona(p *Persona, meta requestMeta) (string, error) {
+	prompt, err := p.Render(bot.promptData(meta))
+	if err != nil {
+		bot.logger.Println("Error rendering persona:", err)
+		return "", &userFacingError{fmt.Sprintf("The system prompt of persona `%s` could not be rendered: %v", p.Name, err)}
+	}
+	return prompt, nil
+}
+
+// SetPersona handles the /persona command.
+func (bot *OpenAIChatBot) SetPersona(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	respond := func(content string) {
+		err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{Content: content},
+		})
+		if err != nil {
+			bot.logger.Println("Error responding to interaction:", err)
+		}
+	}
+
+	var name string
+	for _, o := range i.ApplicationCommandData().Options {
+		if o.Name == "name" {
+			name = o.StringValue()
+		}
+	}
+	if name == "" {
+		current := bot.personas.Active(i.ChannelID).Name
+		var sb strings.Builder
+		sb.WriteString("Available personas:\n")
+		for _, n := range bot.personas.Names() {
+			p, _ := bot.personas.Get(n)
+			marker := ""
+			if n == current {
+				marker = " (active)"
+			}
+			fmt.Fprintf(&sb, "- `%s`%s %s\n", n, marker, p.Description)
+		}
+		respond(sb.String())
+		return
+	}
+
+	p, ok := bot.personas.Get(name)
+	if !ok {
+		respond(fmt.Sprintf("Unknown persona `%s`.", name))
+		return
+	}
+	// check the template before switching so that the channel keeps a working persona
+	if _, err := bot.renderPersona(p, interactionMeta("persona", s, i)); err != nil {
+		respond(err.Error())
+		return
+	}
+	bot.personas.SetActive(i.ChannelID, p.Name)
+	respond(fmt.Sprintf("Switched to persona `%s`.", p.Name))
+}
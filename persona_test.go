@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ewohltman/discordgo-mock/mockconstants"
+)
+
+func writePersonas(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadPersonas(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		want    string
+		wantErr bool
+	}{
+		{"Valid", map[string]string{
+			"pirate.yaml": "name: pirate\nmodel: pirate-model\ntemperature: 1.2\nsystem_prompt: Talk like a pirate.\n",
+			"tutor.yml":   "name: tutor\nsystem_prompt: You teach in {{.GuildName}}.\n",
+			"notes.txt":   "ignored",
+		}, "default,pirate,tutor", false},
+		{"ReplaceDefault", map[string]string{
+			"default.yaml": "name: default\nsystem_prompt: Be brief.\n",
+		}, "default", false},
+		{"Duplicate", map[string]string{
+			"a.yaml": "name: a\nsystem_prompt: A\n",
+			"b.yaml": "name: a\nsystem_prompt: B\n",
+		}, "", true},
+		{"MissingName", map[string]string{"a.yaml": "system_prompt: A\n"}, "", true},
+		{"MissingPrompt", map[string]string{"a.yaml": "name: a\n"}, "", true},
+		{"Temperature", map[string]string{"a.yaml": "name: a\ntemperature: 3\nsystem_prompt: A\n"}, "", true},
+		{"InvalidTemplate", map[string]string{"a.yaml": "name: a\nsystem_prompt: \"{{.GuildName\"\n"}, "", true},
+		{"InvalidYAML", map[string]string{"a.yaml": "name: [a\n"}, "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			personas, err := loadPersonas(writePersonas(t, test.files))
+			var lib *PersonaLibrary
+			if err == nil {
+				lib, err = NewPersonaLibrary("", personas...)
+			}
+			if (err != nil) != test.wantErr {
+				t.Fatalf("returned %v, want error: %v", err, test.wantErr)
+			}
+			if err == nil && strings.Join(lib.Names(), ",") != test.want {
+				t.Errorf("expected personas %v, got %v", test.want, lib.Names())
+			}
+		})
+	}
+
+	if _, err := NewPersonaLibrary("missing"); err == nil {
+		t.Error("expected an error for an undefined default persona")
+	}
+}
+
+func TestPersonaReply(t *testing.T) {
+	temperature := float32(0.2)
+	lib, err := NewPersonaLibrary("",
+		&Persona{Name: "host", Model: "host-model", Temperature: &temperature,
+			SystemPrompt: "You are the host of {{.GuildName}} in #{{.ChannelName}}. Greet {{.UserName}}."},
+		&Persona{Name: "broken", SystemPrompt: "Today is {{.Weekday}}."},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := newFakeOpenAI(t, fakeResponse{Content: "Welcome!"})
+	bot, sender := newTestOpenAIChatBot(t, fake, WithPersonas(lib))
+	s := newSession()
+	recorder := recordInteractions(s)
+
+	bot.SetPersona(s, commandInteraction("persona", stringOption("name", "broken")))
+	bot.SetPersona(s, commandInteraction("persona", stringOption("name", "host")))
+	bot.SetPersona(s, commandInteraction("persona"))
+	got := recorder.Responses()
+	if len(got) != 3 || !strings.Contains(got[0], "could not be rendered") ||
+		got[1] != "Switched to persona `host`." || !strings.Contains(got[2], "`host` (active)") {
+		t.Fatalf("unexpected responses %#v", got)
+	}
+
+	bot.HandleReply(s, mentionMessage("hi"))
+	reqs := fake.Requests()
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(reqs))
+	}
+	want := "You are the host of " + mockconstants.TestGuild + " in #" + mockconstants.TestChannel + ". Greet Test user."
+	if reqs[0].Messages[0].Content != want {
+		t.Errorf("expected system prompt %q, got %q", want, reqs[0].Messages[0].Content)
+	}
+	if reqs[0].Model != "host-model" || reqs[0].Temperature != temperature {
+		t.Errorf("expected the model settings of the persona, got %v %v", reqs[0].Model, reqs[0].Temperature)
+	}
+	if msgs := sender.Messages[mockconstants.TestChannel]; len(msgs) != 1 || msgs[0] != "Welcome!\n" {
+		t.Errorf("unexpected messages %#v", msgs)
+	}
+
+	// a persona failing at request time is reported to the channel
+	bot.personas.SetActive(mockconstants.TestChannel, "broken")
+	bot.HandleReply(s, mentionMessage("hi"))
+	if msgs := sender.Messages[mockconstants.TestChannel]; len(msgs) != 2 || !strings.Contains(msgs[1], "could not be rendered") {
+		t.Errorf("expected the render error to be reported, got %#v", msgs)
+	}
+}
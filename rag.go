@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// number of texts embedded in one request
+const embeddingBatchSize = 64
+
+// file extensions ingested into the RAG index
+var ragExtensions = []string{".md", ".markdown", ".txt"}
+
+// RAGChunk is a piece of a document with its embedding
+type RAGChunk struct {
+	Source  string    `json:"source"`
+	Heading string    `json:"heading,omitempty"`
+	Text    string    `json:"text"`
+	Vector  []float32 `json:"vector"`
+}
+
+// RAGIndex is the local vector index written by the ingest command.
+type RAGIndex struct {
+	// embedding model used for the chunks, queries have to use the same one
+	Model  string     `json:"model"`
+	Chunks []RAGChunk `json:"chunks"`
+}
+
+type RAGResult struct {
+	Chunk RAGChunk
+	Score float64
+}
+
+type RAGConfig struct {
+	// path of the index. Retrieval is disabled if empty.
+	IndexPath string
+	// channels using retrieval, "*" for all channels
+	Channels []string
+	// number of chunks added to the prompt
+	TopK int
+	// chunks less similar than this are ignored
+	MinScore float64
+}
+
+func ragConfigFromEnv() (RAGConfig, error) {
+	c := RAGConfig{
+		IndexPath: os.Getenv("RAG_INDEX"),
+		Channels:  envList("RAG_CHANNELS"),
+	}
+	var err error
+	if c.TopK, err = envInt("RAG_TOP_K", 4); err != nil {
+		return c, err
+	}
+	minScore, err := envInt("RAG_MIN_SCORE_PERCENT", 30)
+	if err != nil {
+		return c, err
+	}
+	c.MinScore = float64(minScore) / 100
+	return c, nil
+}
+
+// Enabled reports whether retrieval is used in the channel
+func (c RAGConfig) Enabled(channelID string) bool {
+	return slices.Contains(c.Channels, "*") || slices.Contains(c.Channels, channelID)
+}
+
+func loadRAGIndex(path string) (*RAGIndex, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var idx RAGIndex
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if idx.Model == "" {
+		return nil, fmt.Errorf("%s: embedding model is not recorded", path)
+	}
+	return &idx, nil
+}
+
+// Search returns the k chunks most similar to the normalized vector.
+func (idx *RAGIndex) Search(vector []float32, k int, minScore float64) []RAGResult {
+	var results []RAGResult
+	for _, c := range idx.Chunks {
+		if len(c.Vector) != len(vector) {
+			continue
+		}
+		var score float64
+		for i := range vector {
+			score += float64(vector[i]) * float64(c.Vector[i])
+		}
+		if score >= minScore {
+			results = append(results, RAGResult{Chunk: c, Score: score})
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	return results[:min(k, len(results))]
+}
+
+func normalize(v []float32) []float32 {
+	var norm float64
+	for _, x := range v {
+		norm += float64(x) * float64(x)
+	}
+	norm = math.Sqrt(norm)
+	if norm == 0 {
+		return v
+	}
+	out := make([]float32, len(v))
+	for i, x := range v {
+		out[i] = float32(float64(x) / norm)
+	}
+	return out
+}
+
+// embedder computes normalized embeddings of the inputs
+type embedder func(ctx context.Context, model string, inputs []string) ([][]float32, error)
+
+// clientEmbedder returns an embedder using the client. usage is called with the token usage of every request if not nil.
+func clientEmbedder(client *openai.Client, usage func(model string, u openai.Usage)) embedder {
+	return func(ctx context.Context, model string, inputs []string) ([][]float32, error) {
+		resp, err := client.CreateEmbeddings(ctx, openai.EmbeddingRequestStrings{
+			Input: inputs,
+			Model: openai.EmbeddingModel(model),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if usage != nil {
+			usage(model, resp.Usage)
+		}
+		if len(resp.Data) != len(inputs) {
+			return nil, fmt.Errorf("expected %d embeddings, got %d", len(inputs), len(resp.Data))
+		}
+		vectors := make([][]float32, len(inputs))
+		for _, d := range resp.Data {
+			if d.Index < 0 || d.Index >= len(inputs) {
+				return nil, fmt.Errorf("embedding index %d out of range", d.Index)
+			}
+			vectors[d.Index] = normalize(d.Embedding)
+		}
+		return vectors, nil
+	}
+}
+
+// chunkDocument splits the text at paragraphs into chunks of about size bytes.
+// Paragraphs longer than size are cut with overlap bytes repeated in the next chunk.
+func chunkDocument(source, text string, size, overlap int) []RAGChunk {
+	var chunks []RAGChunk
+	var cur strings.Builder
+	heading, curHeading := "", ""
+	// whether cur has more than headings. The heading is kept in RAGChunk.Heading, so chunks of only headings are dropped.
+	body := false
+	flush := func() {
+		if t := strings.TrimSpace(cur.String()); t != "" && body {
+			chunks = append(chunks, RAGChunk{Source: source, Heading: curHeading, Text: t})
+		}
+		cur.Reset()
+		body = false
+	}
+
+	for _, para := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n\n") {
+		para = strings.TrimSpace(para)
+		if para == "" {
+			continue
+		}
+		isHeading := strings.HasPrefix(para, "#")
+		if isHeading {
+			flush()
+			first, _, _ := strings.Cut(para, "\n")
+			heading = strings.TrimSpace(strings.TrimLeft(first, "#"))
+		}
+		if cur.Len() > 0 && cur.Len()+len(para) > size {
+			flush()
+		}
+		if cur.Len() == 0 {
+			curHeading = heading
+		}
+		for len(para) > size {
+			cut := size
+			for cut > 0 && !utf8.RuneStart(para[cut]) {
+				cut--
+			}
+			chunks = append(chunks, RAGChunk{Source: source, Heading: curHeading, Text: para[:cut]})
+			next := max(cut-overlap, 1)
+			for next < len(para) && !utf8.RuneStart(para[next]) {
+				next++
+			}
+			para = para[next:]
+		}
+		cur.WriteString(para + "\n\n")
+		body = body || !isHeading
+	}
+	flush()
+	return chunks
+}
+
+// RAGRetriever adds the chunks relevant to the prompt to the request.
+type RAGRetriever struct {
+	config RAGConfig
+	index  *RAGIndex
+}
+
+func NewRAGRetriever(c RAGConfig) (*RAGRetriever, error) {
+	idx, err := loadRAGIndex(c.IndexPath)
+	if err != nil {
+		return nil, err
+	}
+	return &RAGRetriever{config: c, index: idx}, nil
+}
+
+// Augment inserts the chunks relevant to the last user message as a system message before it.
+func (r *RAGRetriever) Augment(ctx context.Context, embed embedder, req openai.ChatCompletionRequest) (openai.ChatCompletionRequest, error) {
+	last := -1
+	for i, m := range req.Messages {
+		if m.Role == openai.ChatMessageRoleUser {
+			last = i
+		}
+	}
+	if last < 0 || strings.TrimSpace(req.Messages[last].Content) == "" {
+		return req, nil
+	}
+	vectors, err := embed(ctx, r.index.Model, []string{req.Messages[last].Content})
+	if err != nil {
+		return req, err
+	}
+	results := r.index.Search(vectors[0], r.config.TopK, r.config.MinScore)
+	if len(results) == 0 {
+		return req, nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString("The following excerpts of our documentation may help to answer the next message. " +
+		"If you use them, cite them as [n] and list the cited sources at the end of your answer. " +
+		"Do not make up sources.\n")
+	for n, res := range results {
+		source := res.Chunk.Source
+		if res.Chunk.Heading != "" {
+			source += " — " + res.Chunk.Heading
+		}
+		fmt.Fprintf(&sb, "\n[%d] %s\n%s\n", n+1, source, res.Chunk.Text)
+	}
+	msgs := make([]openai.ChatCompletionMessage, 0, len(req.Messages)+1)
+	msgs = append(msgs, req.Messages[:last]...)
+	msgs = append(msgs, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: sb.String()})
+	msgs = append(msgs, req.Messages[last:]...)
+	req.Messages = msgs
+	return req, nil
+}
+
+// runIngest implements the ingest subcommand which builds the RAG index from a directory of documents.
+func runIngest(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("ingest", flag.ContinueOnError)
+	dir := fs.String("dir", "", "directory of Markdown and text files")
+	out := fs.String("out", "rag-index.json", "path of the index to write")
+	model := fs.String("model", string(openai.SmallEmbedding3), "embedding model")
+	size := fs.Int("chunk-size", 1500, "approximate size of the chunks in bytes")
+	overlap := fs.Int("overlap", 200, "bytes repeated between the pieces of a paragraph longer than the chunk size")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dir == "" {
+		return errors.New("-dir is required")
+	}
+	if *overlap >= *size {
+		return errors.New("-overlap must be smaller than -chunk-size")
+	}
+	config, _, err := openAIConfigFromEnv(&DefaultLogger{})
+	if err != nil {
+		return err
+	}
+	idx, err := buildRAGIndex(context.Background(), clientEmbedder(openai.NewClientWithConfig(config), nil), *dir, *model, *size, *overlap)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*out, b, 0o644); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Wrote %d chunks to %s\n", len(idx.Chunks), *out)
+	return nil
+}
+
+func buildRAGIndex(ctx context.Context, embed embedder, dir, model string, size, overlap int) (*RAGIndex, error) {
+	idx := &RAGIndex{Model: model}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !slices.Contains(ragExtensions, strings.ToLower(filepath.Ext(path))) {
+			return nil
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		source, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		idx.Chunks = append(idx.Chunks, chunkDocument(filepath.ToSlash(source), string(b), size, overlap)...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for start := 0; start < len(idx.Chunks); start += embeddingBatchSize {
+		batch := idx.Chunks[start:min(start+embeddingBatchSize, len(idx.Chunks))]
+		inputs := make([]string, len(batch))
+		for i, c := range batch {
+			// the heading gives context to chunks in the middle of a section
+			inputs[i] = strings.TrimSpace(c.Source + " " + c.Heading + "\n" + c.Text)
+		}
+		vectors, err := embed(ctx, model, inputs)
+		if err != nil {
+			return nil, err
+		}
+		for i := range batch {
+			batch[i].Vector = vectors[i]
+		}
+	}
+	return idx, nil
+}
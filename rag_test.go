@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ewohltman/discordgo-mock/mockconstants"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestChunkDocument(t *testing.T) {
+	text := "# Setup\n\nFirst paragraph.\n\nSecond paragraph.\n\n## Deploy\n\n" + strings.Repeat("あ", 50)
+	chunks := chunkDocument("docs/a.md", text, 40, 10)
+
+	var got []string
+	for _, c := range chunks {
+		if len(c.Text) > 40 {
+			t.Errorf("chunk exceeds the size: %q", c.Text)
+		}
+		got = append(got, c.Heading)
+	}
+	// the long paragraph of 150 bytes is cut into pieces overlapping by about 10 bytes
+	expected := "Setup,Setup,Deploy,Deploy,Deploy,Deploy,Deploy"
+	if strings.Join(got, ",") != expected {
+		t.Errorf("expected headings %v, got %v", expected, strings.Join(got, ","))
+	}
+	if chunks[0].Text != "# Setup\n\nFirst paragraph." {
+		t.Errorf("unexpected first chunk %q", chunks[0].Text)
+	}
+}
+
+func TestRAGIngestAndAugment(t *testing.T) {
+	fake := newFakeOpenAI(t, fakeResponse{Content: "See [1]."})
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "install.md"), []byte("# Install\n\nRun the installer to install the bot."), 0o600)
+	os.WriteFile(filepath.Join(dir, "billing.txt"), []byte("Billing questions go to the billing team."), 0o600)
+	os.WriteFile(filepath.Join(dir, "image.png"), []byte("not a document"), 0o600)
+
+	idx, err := buildRAGIndex(context.Background(), clientEmbedder(openai.NewClientWithConfig(fake.Config()), nil), dir, "test-embedding", 1000, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Chunks) != 2 {
+		t.Fatalf("expected 2 chunks, got %#v", idx.Chunks)
+	}
+
+	bot, _ := newTestOpenAIChatBot(t, fake)
+	bot.rag = &RAGRetriever{
+		config: RAGConfig{Channels: []string{mockconstants.TestChannel}, TopK: 1, MinScore: 0.3},
+		index:  idx,
+	}
+	reply, err := bot.Reply("how do I install it?", newSession(), mentionMessage("how do I install it?"))
+	if err != nil || reply != "See [1]." {
+		t.Fatalf("Reply = %q, %v", reply, err)
+	}
+
+	msgs := fake.Requests()[0].Messages
+	if len(msgs) != 3 || msgs[1].Role != openai.ChatMessageRoleSystem {
+		t.Fatalf("expected the excerpts before the prompt, got %#v", msgs)
+	}
+	if !strings.Contains(msgs[1].Content, "[1] install.md — Install") || strings.Contains(msgs[1].Content, "billing") {
+		t.Errorf("expected only the install document, got %q", msgs[1].Content)
+	}
+	// the excerpts are not kept in the context
+	if c := bot.chatContext[mockconstants.TestChannel]; len(c.Messages) != 3 {
+		t.Errorf("expected 3 messages in the context, got %#v", c.Messages)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// window of the daily token quotas
+const quotaWindow = 24 * time.Hour
+
+// number of buckets above which full buckets are dropped
+const maxRateBuckets = 10000
+
+type RateLimitConfig struct {
+	// requests per minute, 0 for no limit
+	UserRPM    int
+	ChannelRPM int
+	GuildRPM   int
+	// tokens per 24 hours, 0 for no quota
+	UserDailyTokens    int
+	ChannelDailyTokens int
+	GuildDailyTokens   int
+	// members with one of these roles are not limited
+	ExemptRoles []string
+}
+
+func rateLimitConfigFromEnv() (RateLimitConfig, error) {
+	c := RateLimitConfig{ExemptRoles: envList("RATE_LIMIT_EXEMPT_ROLES")}
+	for _, v := range []struct {
+		name string
+		dst  *int
+	}{
+		{"RATE_LIMIT_USER_RPM", &c.UserRPM},
+		{"RATE_LIMIT_CHANNEL_RPM", &c.ChannelRPM},
+		{"RATE_LIMIT_GUILD_RPM", &c.GuildRPM},
+		{"QUOTA_USER_DAILY_TOKENS", &c.UserDailyTokens},
+		{"QUOTA_CHANNEL_DAILY_TOKENS", &c.ChannelDailyTokens},
+		{"QUOTA_GUILD_DAILY_TOKENS", &c.GuildDailyTokens},
+	} {
+		var err error
+		if *v.dst, err = envInt(v.name, 0); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+func (c RateLimitConfig) Enabled() bool {
+	return c.UserRPM > 0 || c.ChannelRPM > 0 || c.GuildRPM > 0 ||
+		c.UserDailyTokens > 0 || c.ChannelDailyTokens > 0 || c.GuildDailyTokens > 0
+}
+
+// tokenBucket holds up to one minute of requests and refills continuously
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter enforces the request rates and daily token quotas of users, channels and guilds.
+type RateLimiter struct {
+	config RateLimitConfig
+	usage  *UsageStore
+	now    func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func NewRateLimiter(c RateLimitConfig, usage *UsageStore) *RateLimiter {
+	return &RateLimiter{
+		config:  c,
+		usage:   usage,
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// limit is a rate limit or quota applying to a request
+type limit struct {
+	key   string
+	value int
+	// subject of the message shown when the limit is hit
+	subject string
+	match   func(UsageRecord) bool
+}
+
+func (rl *RateLimiter) limits(meta requestMeta, rpm bool) []limit {
+	var limits []limit
+	add := func(kind, id string, value int, subject string, match func(UsageRecord) bool) {
+		if id != "" && value > 0 {
+			limits = append(limits, limit{key: kind + ":" + id, value: value, subject: subject, match: match})
+		}
+	}
+	c := rl.config
+	if rpm {
+		add("user", meta.UserID, c.UserRPM, "You are", nil)
+		add("channel", meta.ChannelID, c.ChannelRPM, "This channel is", nil)
+		add("guild", meta.GuildID, c.GuildRPM, "This server is", nil)
+		return limits
+	}
+	add("user", meta.UserID, c.UserDailyTokens, "Your daily token quota", func(r UsageRecord) bool { return r.UserID == meta.UserID })
+	add("channel", meta.ChannelID, c.ChannelDailyTokens, "The daily token quota of this channel", func(r UsageRecord) bool { return r.ChannelID == meta.ChannelID })
+	add("guild", meta.GuildID, c.GuildDailyTokens, "The daily token quota of this server", func(r UsageRecord) bool { return r.GuildID == meta.GuildID })
+	return limits
+}
+
+// Allow takes a request of each applicable bucket, or returns a userFacingError explaining which limit is hit.
+// Nothing is taken if a limit is hit.
+func (rl *RateLimiter) Allow(meta requestMeta) error {
+	if slices.ContainsFunc(meta.RoleIDs, func(id string) bool { return slices.Contains(rl.config.ExemptRoles, id) }) {
+		return nil
+	}
+	now := rl.now()
+	for _, l := range rl.limits(meta, false) {
+		total := rl.usage.Sum(now.Add(-quotaWindow), l.match, func(UsageRecord) string { return "" })[""]
+		if total != nil && total.Tokens() >= l.value {
+			return &userFacingError{fmt.Sprintf("%s (%d tokens) is used up. Please try again later.", l.subject, l.value)}
+		}
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	limits := rl.limits(meta, true)
+	for _, l := range limits {
+		b := rl.bucket(l, now)
+		if b.tokens < 1 {
+			perSecond := float64(l.value) / 60
+			wait := math.Ceil((1 - b.tokens) / perSecond)
+			return &userFacingError{fmt.Sprintf("%s sending requests too quickly. Please try again in %.0f seconds.", l.subject, wait)}
+		}
+	}
+	for _, l := range limits {
+		rl.buckets[l.key].tokens--
+	}
+	if len(rl.buckets) > maxRateBuckets {
+		rl.prune(now)
+	}
+	return nil
+}
+
+// bucket returns the refilled bucket of the limit
+func (rl *RateLimiter) bucket(l limit, now time.Time) *tokenBucket {
+	b, ok := rl.buckets[l.key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.value), last: now}
+		rl.buckets[l.key] = b
+	}
+	b.tokens = min(float64(l.value), b.tokens+now.Sub(b.last).Minutes()*float64(l.value))
+	b.last = now
+	return b
+}
+
+// prune drops the buckets which have been refilled, they are recreated full when needed
+func (rl *RateLimiter) prune(now time.Time) {
+	for key, b := range rl.buckets {
+		if now.Sub(b.last) >= time.Minute {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// functional option to limit the requests and tokens of users, channels and guilds
+func WithRateLimits(c RateLimitConfig) ChatBotOption {
+	return func(s *OpenAIChatBot) {
+		s.rateLimitConfig = c
+	}
+}
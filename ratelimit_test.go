@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ewohltman/discordgo-mock/mockconstants"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestRateLimiterRPM(t *testing.T) {
+	usage, _ := NewUsageStore(UsageConfig{})
+	rl := NewRateLimiter(RateLimitConfig{UserRPM: 2, ChannelRPM: 3, ExemptRoles: []string{"trusted"}}, usage)
+	now := time.Now()
+	rl.now = func() time.Time { return now }
+	alice := requestMeta{GuildID: "g", ChannelID: "c", UserID: "alice"}
+	bob := requestMeta{GuildID: "g", ChannelID: "c", UserID: "bob"}
+	admin := requestMeta{GuildID: "g", ChannelID: "c", UserID: "admin", RoleIDs: []string{"member", "trusted"}}
+
+	steps := []struct {
+		meta    requestMeta
+		advance time.Duration
+		err     string
+	}{
+		{alice, 0, ""},
+		{alice, 0, ""},
+		{alice, 0, "You are sending requests too quickly. Please try again in 30 seconds."},
+		{bob, 0, ""},
+		// the channel bucket is empty, bob's bucket is not taken
+		{bob, 0, "This channel is sending requests too quickly. Please try again in 20 seconds."},
+		{admin, 0, ""},
+		{alice, 30 * time.Second, ""},
+		{bob, 20 * time.Second, ""},
+		{bob, 0, "This channel is sending requests too quickly. Please try again in 10 seconds."},
+	}
+	for n, step := range steps {
+		now = now.Add(step.advance)
+		err := rl.Allow(step.meta)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != step.err {
+			t.Errorf("step %d: expected %q, got %q", n, step.err, got)
+		}
+	}
+}
+
+func TestRateLimiterQuota(t *testing.T) {
+	usage, _ := NewUsageStore(UsageConfig{})
+	rl := NewRateLimiter(RateLimitConfig{UserDailyTokens: 100, GuildDailyTokens: 150}, usage)
+	alice := requestMeta{GuildID: "g", ChannelID: "c", UserID: "alice"}
+	bob := requestMeta{GuildID: "g", ChannelID: "c", UserID: "bob"}
+
+	usage.Record(alice, "m", openai.Usage{PromptTokens: 60, CompletionTokens: 40})
+	if err := rl.Allow(alice); err == nil || err.Error() != "Your daily token quota (100 tokens) is used up. Please try again later." {
+		t.Errorf("expected the user quota to be hit, got %v", err)
+	}
+	if err := rl.Allow(bob); err != nil {
+		t.Errorf("expected bob to be allowed, got %v", err)
+	}
+	usage.Record(bob, "m", openai.Usage{PromptTokens: 50})
+	if err := rl.Allow(bob); err == nil || !strings.Contains(err.Error(), "quota of this server") {
+		t.Errorf("expected the server quota to be hit, got %v", err)
+	}
+	// DMs are not subject to the quota of a server
+	if err := rl.Allow(requestMeta{ChannelID: "dm", UserID: "bob"}); err != nil {
+		t.Errorf("expected a DM to be allowed, got %v", err)
+	}
+
+	rl.now = func() time.Time { return time.Now().Add(quotaWindow) }
+	if err := rl.Allow(alice); err != nil {
+		t.Errorf("expected the quota to free up after a day, got %v", err)
+	}
+}
+
+func TestRateLimitedBeforeModeration(t *testing.T) {
+	fake := newFakeOpenAI(t, fakeResponse{Content: "Hi!"})
+	bot, sender := newTestOpenAIChatBot(t, fake,
+		WithRateLimits(RateLimitConfig{UserRPM: 1}),
+		WithModeration(ModerationConfig{Classifier: ModerationOpenAI, Action: ModerationBlock, Threshold: 0.5, LogChannel: "mods"}),
+	)
+	s := newSession()
+	incidents := recordPosts(s, "mods")
+
+	bot.HandleReply(s, mentionMessage("hello"))
+	bot.HandleReply(s, mentionMessage("violence"))
+
+	if got := fake.Moderated(); len(got) != 2 {
+		t.Errorf("expected only the first prompt and reply to be moderated, got %#v", got)
+	}
+	if got := sender.Messages[mockconstants.TestChannel]; len(got) != 2 || len(*incidents) != 0 {
+		t.Errorf("expected the second prompt to be rate limited without incidents, got %#v %#v", got, *incidents)
+	}
+}
+
+func TestReplyRateLimited(t *testing.T) {
+	fake := newFakeOpenAI(t, fakeResponse{Content: "Hi!"})
+	bot, sender := newTestOpenAIChatBot(t, fake, WithRateLimits(RateLimitConfig{UserRPM: 1}))
+	s := newSession()
+
+	bot.HandleReply(s, mentionMessage("hello"))
+	bot.HandleReply(s, mentionMessage("hello again"))
+
+	got := sender.Messages[mockconstants.TestChannel]
+	if len(got) != 2 || !strings.HasPrefix(got[1], "You are sending requests too quickly.") {
+		t.Errorf("expected the second message to be rate limited, got %#v", got)
+	}
+	if n := len(fake.Requests()); n != 1 {
+		t.Errorf("expected 1 request to the API, got %d", n)
+	}
+	// rejected prompts are not sent with later requests
+	c := bot.chatContext[mockconstants.TestChannel]
+	if len(c.Messages) != 3 || strings.TrimSpace(c.Messages[1].Content) != "hello" {
+		t.Errorf("expected the rejected prompt not to be kept, got %#v", c.Messages)
+	}
+}
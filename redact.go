@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// built-in detectors of sensitive data
+var builtinDetectors = map[string]*regexp.Regexp{
+	// OpenAI, Anthropic, AWS, GitHub, Slack and Google keys
+	"api_key":       regexp.MustCompile(`\b(?:sk-(?:proj-|ant-)?[A-Za-z0-9_-]{20,}|AKIA[0-9A-Z]{16}|gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,}|xox[abposr]-[A-Za-z0-9-]{10,}|AIza[0-9A-Za-z_-]{35})`),
+	"discord_token": regexp.MustCompile(`\b[MNO][A-Za-z0-9_-]{23,27}\.[A-Za-z0-9_-]{6}\.[A-Za-z0-9_-]{27,40}\b`),
+	"email":         regexp.MustCompile(`\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b`),
+	// numbers with a country code, an area code in parentheses or dashes, to leave other numbers alone
+	"phone": regexp.MustCompile(`\+\d{1,3}[ .-]?\d{1,4}(?:[ .-]?\d{2,4}){2,3}\b|\(\d{2,4}\)[ .-]?\d{3,4}[ .-]\d{3,4}\b|\b\d{3}[.-]\d{3,4}[.-]\d{4}\b`),
+	// 13 to 16 digits, longer numbers are usually Discord IDs
+	"credit_card": regexp.MustCompile(`\b[2-6]\d{3}(?:[ -]?\d{4}){2}[ -]?\d{1,4}\b`),
+}
+
+// order the built-in detectors run in, so that keys are replaced before their parts look like phone numbers
+var detectorOrder = []string{"api_key", "discord_token", "email", "credit_card", "phone"}
+
+// validators rejecting false positives of the detectors
+var detectorValidators = map[string]func(string) bool{
+	"credit_card": luhn,
+}
+
+// luhn reports whether the digits of s pass the Luhn checksum of card numbers
+func luhn(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] < '0' || s[i] > '9' {
+			continue
+		}
+		d := int(s[i] - '0')
+		if n%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n > 0 && sum%10 == 0
+}
+
+type RedactionConfig struct {
+	// names of the built-in detectors to use
+	Detectors []string
+	// custom detectors by name
+	Patterns map[string]string
+	// tell the user when something was removed from their message
+	Warn bool
+}
+
+func (c RedactionConfig) Enabled() bool {
+	return len(c.Detectors) > 0 || len(c.Patterns) > 0
+}
+
+func redactionConfigFromEnv() (RedactionConfig, error) {
+	c := RedactionConfig{Warn: os.Getenv("REDACTION_WARN") == "true"}
+	switch v := os.Getenv("REDACTION"); v {
+	case "":
+	case "all":
+		c.Detectors = detectorOrder
+	default:
+		c.Detectors = envList("REDACTION")
+	}
+	for _, name := range c.Detectors {
+		if builtinDetectors[name] == nil {
+			return c, fmt.Errorf("REDACTION: unknown detector %q", name)
+		}
+	}
+	if path := os.Getenv("REDACTION_PATTERNS"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return c, err
+		}
+		if err := json.Unmarshal(b, &c.Patterns); err != nil {
+			return c, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return c, nil
+}
+
+type detector struct {
+	name  string
+	re    *regexp.Regexp
+	valid func(string) bool
+}
+
+// Redactor replaces sensitive data with placeholders such as [EMAIL]
+type Redactor struct {
+	detectors []detector
+	warn      bool
+}
+
+func NewRedactor(c RedactionConfig) (*Redactor, error) {
+	r := &Redactor{warn: c.Warn}
+	for _, name := range c.Detectors {
+		if builtinDetectors[name] == nil {
+			return nil, fmt.Errorf("unknown detector %q", name)
+		}
+	}
+	for _, name := range detectorOrder {
+		if slices.Contains(c.Detectors, name) {
+			r.detectors = append(r.detectors, detector{name: name, re: builtinDetectors[name], valid: detectorValidators[name]})
+		}
+	}
+	names := make([]string, 0, len(c.Patterns))
+	for name := range c.Patterns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		re, err := regexp.Compile(c.Patterns[name])
+		if err != nil {
+			return nil, fmt.Errorf("pattern %s: %w", name, err)
+		}
+		r.detectors = append(r.detectors, detector{name: name, re: re})
+	}
+	return r, nil
+}
+
+// Redact returns the text with the matches of the detectors replaced and the names of the detectors which matched.
+func (r *Redactor) Redact(text string) (string, []string) {
+	var found []string
+	for _, d := range r.detectors {
+		placeholder := "[" + strings.ToUpper(d.name) + "]"
+		text = d.re.ReplaceAllStringFunc(text, func(match string) string {
+			if d.valid != nil && !d.valid(match) {
+				return match
+			}
+			if !slices.Contains(found, d.name) {
+				found = append(found, d.name)
+			}
+			return placeholder
+		})
+	}
+	return text, found
+}
+
+// functional option to redact sensitive data from the messages sent to the model
+func WithRedaction(c RedactionConfig) ChatBotOption {
+	return func(s *OpenAIChatBot) {
+		if !c.Enabled() {
+			return
+		}
+		r, err := NewRedactor(c)
+		if err != nil {
+			s.logger.Fatal("Invalid redaction configuration: ", err)
+		}
+		s.redactor.Store(r)
+	}
+}
+
+// redact removes sensitive data from a prompt before it is kept or sent, warning the user if configured.
+func (bot *OpenAIChatBot) redact(meta requestMeta, prompt string) string {
+	r := bot.redactor.Load()
+	if r == nil {
+		return prompt
+	}
+	redacted, found := r.Redact(prompt)
+	if len(found) == 0 {
+		return prompt
+	}
+	bot.logger.Println("Redacted", strings.Join(found, ", "), "from a message of user", meta.UserID, "in channel", meta.ChannelID)
+	if r.warn && meta.Status != nil {
+		meta.Status(fmt.Sprintf("⚠️ Removed sensitive data (%s) from your message before sending it to the model.", strings.Join(found, ", ")))
+	}
+	return redacted
+}
+
+// redactText removes sensitive data from text kept outside of requests, such as in the feedback log
+func (bot *OpenAIChatBot) redactText(text string) string {
+	r := bot.redactor.Load()
+	if r == nil {
+		return text
+	}
+	text, _ = r.Redact(text)
+	return text
+}
+
+// redactRequest removes sensitive data from the messages of the request but the system prompt of the persona,
+// covering content which did not pass redact such as transcripts, tool results and retrieved documents.
+// The reference material in the system prompt is redacted by systemPrompt.
+func (bot *OpenAIChatBot) redactRequest(req openai.ChatCompletionRequest) openai.ChatCompletionRequest {
+	r := bot.redactor.Load()
+	if r == nil {
+		return req
+	}
+	req.Messages = append([]openai.ChatCompletionMessage{}, req.Messages...)
+	for n, msg := range req.Messages {
+		if n == 0 && msg.Role == openai.ChatMessageRoleSystem {
+			continue
+		}
+		req.Messages[n].Content, _ = r.Redact(msg.Content)
+	}
+	return req
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// user ID of the bot in replayed sessions. It has to be numeric to be removed by removeMention.
+const replayBotID = "1"
+
+// separator between outgoing messages in replay diffs
+const replayMessageBreak = "----- message break -----"
+
+// errReplayMismatch is returned by runReplay when the replayed messages differ from the recorded ones.
+var errReplayMismatch = errors.New("replayed messages differ from the recording")
+
+// recordingSender implements Sender by remembering the messages instead of sending them to Discord.
+type recordingSender struct {
+	messages []string
+}
+
+func (rs *recordingSender) ChannelSend(s *discordgo.Session, channelID string, content string) (*discordgo.Message, error) {
+	rs.messages = append(rs.messages, content)
+	return &discordgo.Message{ID: fmt.Sprint(len(rs.messages)), ChannelID: channelID, Content: content}, nil
+}
+
+func (rs *recordingSender) ReplySend(s *discordgo.Session, channelID string, content string, reference *discordgo.MessageReference) (*discordgo.Message, error) {
+	return rs.ChannelSend(s, channelID, content)
+}
+
+func (rs *recordingSender) ComplexSend(s *discordgo.Session, channelID string, data *discordgo.MessageSend) (*discordgo.Message, error) {
+	return rs.ChannelSend(s, channelID, data.Content)
+}
+
+func (rs *recordingSender) FollowupSend(s *discordgo.Session, i *discordgo.Interaction, data *discordgo.WebhookParams) (*discordgo.Message, error) {
+	return rs.ChannelSend(s, i.ChannelID, data.Content)
+}
+
+// take returns the messages sent since the last call
+func (rs *recordingSender) take() []string {
+	m := rs.messages
+	rs.messages = nil
+	return m
+}
+
+// runReplay implements the replay subcommand which feeds the prompts of an audit log through HandleReply
+// and diffs the outgoing messages against the recorded responses.
+func runReplay(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	logPath := fs.String("log", "", "audit log recorded with AUDIT_LOG_CONTENT=full")
+	backend := fs.String("backend", "fake", "backend generating the replies: \"fake\" answers with the recorded responses, \"openai\" calls the API")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *logPath == "" {
+		return errors.New("-log is required")
+	}
+	entries, err := readReplayEntries(*logPath)
+	if err != nil {
+		return err
+	}
+
+	personas, err := personaLibraryFromEnv()
+	if err != nil {
+		return fmt.Errorf("invalid personas: %w", err)
+	}
+	recorder := &recordingSender{}
+	opts := []ChatBotOption{WithSender(recorder), WithPersonas(personas)}
+	var fake *replayBackend
+	switch *backend {
+	case "fake":
+		fake = &replayBackend{}
+		config := openai.DefaultConfig("replay")
+		config.HTTPClient = fake
+		opts = append(opts, WithClientConfig(config))
+	case "openai":
+	default:
+		return fmt.Errorf("unknown backend %q", *backend)
+	}
+	bot, err := NewOpenAIChatBot(opts...)
+	if err != nil {
+		return err
+	}
+
+	if replay(w, bot.HandleReply, recorder, fake, entries) > 0 {
+		return errReplayMismatch
+	}
+	return nil
+}
+
+// readReplayEntries reads the replies from the audit log at path.
+// Only requests answering a prompt of a user with a final answer are replayed:
+// the requests inside the tool calling loop send tool results, and the answers calling tools have no text to compare.
+func readReplayEntries(path string) ([]AuditEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64<<10), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if entry.Kind != "reply" || entry.ErrorClass != "" {
+			continue
+		}
+		// older recordings do not have the role of the prompt
+		if entry.PromptRole != "" && entry.PromptRole != openai.ChatMessageRoleUser || entry.FinishReason == string(openai.FinishReasonToolCalls) {
+			continue
+		}
+		if entry.Prompt == "" || strings.HasPrefix(entry.Prompt, "[redacted ") {
+			return nil, fmt.Errorf("%s:%d: prompt is not recorded, set AUDIT_LOG_CONTENT=full when recording", path, line)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// replayBackend implements openai.HTTPDoer by answering chat completions with the recorded response of the entry being replayed.
+// It remembers the model and the prompt of the request to compare them with the recording.
+type replayBackend struct {
+	entry  AuditEntry
+	model  string
+	prompt string
+}
+
+func (b *replayBackend) Do(req *http.Request) (*http.Response, error) {
+	if !strings.HasSuffix(req.URL.Path, "/chat/completions") {
+		return nil, fmt.Errorf("the fake backend only answers chat completions, got %s", req.URL.Path)
+	}
+	var r openai.ChatCompletionRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+	b.model = r.Model
+	if n := len(r.Messages); n > 0 {
+		b.prompt = r.Messages[n-1].Content
+	}
+	body, err := json.Marshal(openai.ChatCompletionResponse{
+		Object: "chat.completion",
+		Model:  b.entry.Model,
+		Choices: []openai.ChatCompletionChoice{{
+			Message:      openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: b.entry.Response},
+			FinishReason: openai.FinishReason(b.entry.FinishReason),
+		}},
+		Usage: openai.Usage{
+			PromptTokens:     b.entry.PromptTokens,
+			CompletionTokens: b.entry.CompletionTokens,
+			TotalTokens:      b.entry.TotalTokens,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+// replay sends each prompt to handler as a message mentioning the bot and writes a diff to w for every reply that differs from the recording.
+// With the fake backend, the model and the prompt sent to it are compared as well.
+// It returns the number of differing replies.
+func replay(w io.Writer, handler func(*discordgo.Session, *discordgo.MessageCreate), recorder *recordingSender, fake *replayBackend, entries []AuditEntry) int {
+	botUser := &discordgo.User{ID: replayBotID, Username: "replay", Bot: true}
+	state := discordgo.NewState()
+	state.User = botUser
+	s := &discordgo.Session{State: state}
+
+	mismatches := 0
+	for n, entry := range entries {
+		userID := entry.UserID
+		if userID == "" {
+			userID = "0"
+		}
+		if fake != nil {
+			*fake = replayBackend{entry: entry}
+		}
+		handler(s, &discordgo.MessageCreate{
+			Message: &discordgo.Message{
+				ID:        fmt.Sprintf("replay-%d", n),
+				GuildID:   entry.GuildID,
+				ChannelID: entry.ChannelID,
+				// the mention is removed before the prompt is sent to the model
+				Content:  entry.Prompt + "<@" + replayBotID + ">",
+				Author:   &discordgo.User{ID: userID},
+				Mentions: []*discordgo.User{botUser},
+			},
+		})
+
+		expected := splitMessage(entry.Response, 2000)
+		got := recorder.take()
+		var expectedRequest, gotRequest []string
+		if fake != nil {
+			model := fake.model
+			if entry.Model == "" {
+				// older recordings may not have the model
+				model = ""
+			}
+			expectedRequest = requestLines(entry.Model, entry.Prompt)
+			gotRequest = requestLines(model, fake.prompt)
+		}
+		if strings.Join(expected, "\x00") == strings.Join(got, "\x00") && slices.Equal(expectedRequest, gotRequest) {
+			fmt.Fprintf(w, "ok   #%d %s %s\n", n, entry.Time.Format("2006-01-02T15:04:05Z"), entry.ChannelID)
+			continue
+		}
+		mismatches++
+		fmt.Fprintf(w, "DIFF #%d %s %s\n", n, entry.Time.Format("2006-01-02T15:04:05Z"), entry.ChannelID)
+		fmt.Fprintf(w, "prompt: %s\n--- recorded\n+++ replayed\n", entry.Prompt)
+		expectedLines := append(expectedRequest, messageLines(expected)...)
+		gotLines := append(gotRequest, messageLines(got)...)
+		for _, l := range diffLines(expectedLines, gotLines) {
+			fmt.Fprintln(w, l)
+		}
+	}
+	fmt.Fprintf(w, "%d replies, %d differ\n", len(entries), mismatches)
+	return mismatches
+}
+
+// requestLines returns the model, if known, and the prompt of a request followed by a message break
+func requestLines(model, prompt string) []string {
+	var lines []string
+	if model != "" {
+		lines = append(lines, "model: "+model)
+	}
+	for _, l := range strings.Split(prompt, "\n") {
+		lines = append(lines, "> "+l)
+	}
+	return append(lines, replayMessageBreak)
+}
+
+func messageLines(msgs []string) []string {
+	var lines []string
+	for n, m := range msgs {
+		if n > 0 {
+			lines = append(lines, replayMessageBreak)
+		}
+		lines = append(lines, strings.Split(strings.TrimSuffix(m, "\n"), "\n")...)
+	}
+	return lines
+}
+
+// diffLines returns a line diff of a and b based on their longest common subsequence.
+// Lines are prefixed with "- " if only in a, "+ " if only in b and "  " if in both.
+func diffLines(a, b []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var out []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, "  "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, "- "+a[i])
+			i++
+		default:
+			out = append(out, "+ "+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, "- "+a[i])
+	}
+	for ; j < len(b); j++ {
+		out = append(out, "+ "+b[j])
+	}
+	return out
+}
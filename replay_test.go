@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func writeAuditEntries(t *testing.T, entries ...AuditEntry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, e := range entries {
+		b, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(append(b, '\n'))
+	}
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRunReplayFake(t *testing.T) {
+	path := writeAuditEntries(t,
+		AuditEntry{Kind: "reply", ChannelID: "c1", Prompt: "hello", Response: "hi there"},
+		AuditEntry{Kind: "regenerate", ChannelID: "c1", Prompt: "hello", Response: "hello!"},
+		AuditEntry{Kind: "reply", ChannelID: "c1", Prompt: "fail", ErrorClass: "api_500"},
+		AuditEntry{Kind: "reply", ChannelID: "c2", Prompt: "long", Response: strings.Repeat("line\n", 500)},
+	)
+	var out bytes.Buffer
+	if err := runReplay([]string{"-log", path}, &out); err != nil {
+		t.Fatalf("unexpected error %v:\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "2 replies, 0 differ") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+}
+
+func TestRunReplayToolCalls(t *testing.T) {
+	path := writeAuditEntries(t,
+		AuditEntry{Kind: "reply", ChannelID: "c1", PromptRole: "user", Prompt: "what time is it?", FinishReason: "tool_calls"},
+		AuditEntry{Kind: "reply", ChannelID: "c1", PromptRole: "tool", Prompt: "2026-10-19T12:00:00Z", Response: "It is noon.", FinishReason: "stop"},
+		AuditEntry{Kind: "reply", ChannelID: "c1", PromptRole: "user", Prompt: "thanks", Response: "You're welcome.", FinishReason: "stop"},
+	)
+	entries, err := readReplayEntries(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Prompt != "thanks" {
+		t.Errorf("expected only the prompt answered without tools, got %#v", entries)
+	}
+	var out bytes.Buffer
+	if err := runReplay([]string{"-log", path}, &out); err != nil {
+		t.Fatalf("unexpected error %v:\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "1 replies, 0 differ") || strings.Contains(out.String(), "2026-10-19T12:00:00Z") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+}
+
+func TestRunReplayFakePromptPath(t *testing.T) {
+	unsetenv(t, "PERSONAS_DIR", "PERSONA_DEFAULT")
+	t.Setenv("DEFAULT_MODEL", "gpt-new")
+	path := writeAuditEntries(t,
+		AuditEntry{Kind: "reply", ChannelID: "c1", Model: "gpt-new", Prompt: "hello", Response: "hi there"},
+		AuditEntry{Kind: "reply", ChannelID: "c1", Model: "gpt-old", Prompt: "again", Response: "same"},
+	)
+	var out bytes.Buffer
+	if err := runReplay([]string{"-log", path}, &out); !errors.Is(err, errReplayMismatch) {
+		t.Fatalf("expected a mismatch, got %v:\n%s", err, out.String())
+	}
+	for _, l := range []string{"2 replies, 1 differ", "- model: gpt-old", "+ model: gpt-new", "  > again", "  same"} {
+		if !strings.Contains(out.String(), l+"\n") {
+			t.Errorf("expected %q in output:\n%s", l, out.String())
+		}
+	}
+}
+
+func TestRunReplayOpenAI(t *testing.T) {
+	fake := newFakeOpenAI(t, fakeResponse{Content: "hi there"}, fakeResponse{Content: "something else"})
+	unsetenv(t, "OPENAI_API_KEY_FILE")
+	t.Setenv("OPENAI_API_KEY", "test-key")
+	t.Setenv("OPENAI_BASE_URL", fake.URL+"/v1")
+	path := writeAuditEntries(t,
+		AuditEntry{Kind: "reply", GuildID: "g1", ChannelID: "c1", Prompt: "hello", Response: "hi there"},
+		AuditEntry{Kind: "reply", GuildID: "g1", ChannelID: "c1", Prompt: "again", Response: "same"},
+	)
+	var out bytes.Buffer
+	if err := runReplay([]string{"-log", path, "-backend", "openai"}, &out); !errors.Is(err, errReplayMismatch) {
+		t.Fatalf("expected a mismatch, got %v:\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "2 replies, 1 differ") || !strings.Contains(out.String(), "+ something else\n") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+	if reqs := fake.Requests(); len(reqs) != 2 || reqs[1].Messages[len(reqs[1].Messages)-1].Content != "again" {
+		t.Errorf("expected the recorded prompts to be sent, got %#v", reqs)
+	}
+}
+
+func TestRunReplayRedacted(t *testing.T) {
+	path := writeAuditEntries(t, AuditEntry{Kind: "reply", ChannelID: "c1", Prompt: "[redacted len=5 sha256=00]"})
+	if err := runReplay([]string{"-log", path}, &bytes.Buffer{}); err == nil {
+		t.Error("expected an error for a log without content")
+	}
+}
+
+func TestReplayDiff(t *testing.T) {
+	entries := []AuditEntry{
+		{Kind: "reply", ChannelID: "c1", Prompt: "hello", Response: "line 1\nline 2"},
+		{Kind: "reply", ChannelID: "c1", Prompt: "again", Response: "same"},
+	}
+	recorder := &recordingSender{}
+	var prompts []string
+	bot := &BaseChatBot{
+		ReplyFunc: func(prompt string, s *discordgo.Session, m *discordgo.MessageCreate) (string, error) {
+			prompts = append(prompts, prompt)
+			if prompt == "hello" {
+				return "line 1\nline 3", nil
+			}
+			return "same", nil
+		},
+		logger: &MockLogger{},
+		sender: recorder,
+	}
+	var out bytes.Buffer
+	if n := replay(&out, bot.HandleReply, recorder, nil, entries); n != 1 {
+		t.Errorf("expected 1 differing reply, got %d:\n%s", n, out.String())
+	}
+	if strings.Join(prompts, ",") != "hello,again" {
+		t.Errorf("expected the recorded prompts, got %v", prompts)
+	}
+	for _, l := range []string{"  line 1", "- line 2", "+ line 3"} {
+		if !strings.Contains(out.String(), l+"\n") {
+			t.Errorf("expected %q in output:\n%s", l, out.String())
+		}
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	got := diffLines([]string{"a", "b", "c"}, []string{"a", "c", "d"})
+	expected := []string{"  a", "- b", "  c", "+ d"}
+	if strings.Join(got, "|") != strings.Join(expected, "|") {
+		t.Errorf("diffLines = %v, want %v", got, expected)
+	}
+}
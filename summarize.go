@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// limits of the /summarize options
+const (
+	defaultSummarizeMessages = 100
+	maxSummarizeMessages     = 1000
+	maxSummarizeHours        = 7 * 24
+)
+
+// minimum value of the integer options
+var minSummarizeOption = 1.0
+
+// maximum length of the transcript summarized in one request
+const summaryChunkChars = 12000
+
+// number of messages fetched per request, the maximum of the API
+const historyPageSize = 100
+
+const (
+	summaryMapPrompt = "You summarize a part of a Discord conversation. Keep who said what, decisions, " +
+		"open questions, action items and links. Be concise and do not add anything that is not in the conversation."
+	summaryDigestPrompt = "You write a digest of a Discord conversation given as a transcript or as summaries of its consecutive parts. " +
+		"Use short bullet points grouped by topic and list decisions, open questions and action items at the end."
+)
+
+var summarizeCommand = &discordgo.ApplicationCommand{
+	Name:        "summarize",
+	Description: "post a digest of the recent messages of this channel or thread",
+	Options: []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionInteger,
+			Name:        "messages",
+			Description: fmt.Sprintf("number of recent messages to summarize (default %d)", defaultSummarizeMessages),
+			MinValue:    &minSummarizeOption,
+			MaxValue:    maxSummarizeMessages,
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionInteger,
+			Name:        "hours",
+			Description: "summarize the messages of the last hours instead",
+			MinValue:    &minSummarizeOption,
+			MaxValue:    maxSummarizeHours,
+		},
+	},
+}
+
+// fetchHistory returns up to limit messages of the channel newer than since in chronological order.
+// since is ignored if zero.
+func fetchHistory(s *discordgo.Session, channelID string, limit int, since time.Time) ([]*discordgo.Message, error) {
+	var msgs []*discordgo.Message
+	before := ""
+	for len(msgs) < limit {
+		n := min(historyPageSize, limit-len(msgs))
+		page, err := s.ChannelMessages(channelID, n, before, "", "")
+		if err != nil {
+			return nil, err
+		}
+		// pages are returned newest first
+		for _, m := range page {
+			if (!since.IsZero() && m.Timestamp.Before(since)) || len(msgs) == limit {
+				slices.Reverse(msgs)
+				return msgs, nil
+			}
+			msgs = append(msgs, m)
+		}
+		if len(page) < n {
+			break
+		}
+		before = page[len(page)-1].ID
+	}
+	slices.Reverse(msgs)
+	return msgs, nil
+}
+
+// transcriptLines formats the messages as lines of a transcript, skipping messages without content.
+func transcriptLines(msgs []*discordgo.Message) []string {
+	var lines []string
+	for _, m := range msgs {
+		content := strings.TrimSpace(m.Content)
+		if len(m.Attachments) > 0 {
+			content = strings.TrimSpace(content + fmt.Sprintf(" [%d attachment(s)]", len(m.Attachments)))
+		}
+		if content == "" {
+			continue
+		}
+		name := "unknown"
+		if m.Member != nil && m.Member.Nick != "" {
+			name = m.Member.Nick
+		} else if m.Author != nil {
+			name = m.Author.DisplayName()
+		}
+		lines = append(lines, fmt.Sprintf("[%s] %s: %s", m.Timestamp.UTC().Format("2006-01-02 15:04"), name, content))
+	}
+	return lines
+}
+
+// chunkLines joins the lines into chunks of at most size bytes. Longer lines are truncated.
+func chunkLines(lines []string, size int) []string {
+	var chunks []string
+	var cur strings.Builder
+	for _, l := range lines {
+		l = truncate(l, size-len("…\n"))
+		if cur.Len() > 0 && cur.Len()+len(l)+1 > size {
+			chunks = append(chunks, cur.String())
+			cur.Reset()
+		}
+		cur.WriteString(l + "\n")
+	}
+	if cur.Len() > 0 {
+		chunks = append(chunks, cur.String())
+	}
+	return chunks
+}
+
+// Summarize handles the /summarize command.
+func (bot *OpenAIChatBot) Summarize(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	})
+	if err != nil {
+		bot.logger.Println("Error responding to interaction:", err)
+	}
+	digest, err := bot.summarize(context.Background(), s, i)
+	if err != nil {
+		digest = bot.interactionError(err)
+	}
+	bot.sendFollowup(s, i, digest, 0)
+}
+
+func (bot *OpenAIChatBot) summarize(ctx context.Context, s *discordgo.Session, i *discordgo.InteractionCreate) (string, error) {
+	limit := defaultSummarizeMessages
+	var since time.Time
+	var hours int64
+	for _, o := range i.ApplicationCommandData().Options {
+		switch o.Name {
+		case "messages":
+			limit = int(o.IntValue())
+		case "hours":
+			hours = o.IntValue()
+		}
+	}
+	if limit < 1 || limit > maxSummarizeMessages || hours < 0 || hours > maxSummarizeHours {
+		return "", &userFacingError{fmt.Sprintf("Up to %d messages or %d hours can be summarized.", maxSummarizeMessages, maxSummarizeHours)}
+	}
+	if hours > 0 {
+		since = time.Now().Add(-time.Duration(hours) * time.Hour)
+		limit = maxSummarizeMessages
+	}
+
+	// the history is read by the bot, so it is only summarized for users who can read it themselves
+	perm := int64(discordgo.PermissionViewChannel | discordgo.PermissionReadMessageHistory)
+	p, err := channelPermissions(s, interactionUserID(i), i.ChannelID)
+	if err != nil {
+		return "", fmt.Errorf("checking permissions: %w", err)
+	}
+	if p&discordgo.PermissionAdministrator == 0 && p&perm != perm {
+		return "", &userFacingError{"You need permission to read the message history of this channel to summarize it."}
+	}
+
+	meta := interactionMeta("summarize", s, i)
+	meta.Untrusted = true
+	// a digest counts as one request, the quotas apply to its tokens
+	if err := bot.allow(meta); err != nil {
+		return "", err
+	}
+
+	msgs, err := fetchHistory(s, i.ChannelID, limit, since)
+	if err != nil {
+		return "", fmt.Errorf("fetching history: %w", err)
+	}
+	lines := transcriptLines(msgs)
+	if len(lines) == 0 {
+		return "", &userFacingError{"There are no messages to summarize."}
+	}
+
+	if err := bot.checkUntrusted(meta, strings.Join(lines, "\n")); err != nil {
+		return "", err
+	}
+	model, err := bot.requestModel(bot.model(i.ChannelID))
+	if err != nil {
+		return "", err
+	}
+	summaries := chunkLines(lines, summaryChunkChars)
+	// map: summarize each part of a transcript too long for one request
+	if len(summaries) > 1 {
+		for n, chunk := range summaries {
+			summary, err := bot.summarizeText(ctx, meta, model, summaryMapPrompt, chunk)
+			if err != nil {
+				return "", err
+			}
+			summaries[n] = summary
+		}
+	}
+	// reduce: combine the summaries until one digest is left
+	for {
+		parts := chunkLines(summaries, summaryChunkChars)
+		if len(parts) > 1 && len(parts) == len(summaries) {
+			return "", errors.New("summaries are too long to be combined")
+		}
+		summaries = summaries[:0]
+		for _, part := range parts {
+			summary, err := bot.summarizeText(ctx, meta, model, summaryDigestPrompt, part)
+			if err != nil {
+				return "", err
+			}
+			summaries = append(summaries, summary)
+		}
+		if len(summaries) == 1 {
+			break
+		}
+	}
+
+	// the digest is moderated like a reply, the summaries of the parts are never shown
+	digest, err := bot.moderate(ctx, meta, summaries[0], true)
+	if err != nil {
+		return "", err
+	}
+	header := fmt.Sprintf("**Summary of the last %d messages**", len(lines))
+	if hours > 0 {
+		header = fmt.Sprintf("**Summary of the last %d hours (%d messages)**", hours, len(lines))
+	}
+	return header + "\n" + digest, nil
+}
+
+// summarizeText sends a single request without the conversation, tools or reference material of the channel.
+// The text is delimited as untrusted since it was written by the members of the channel.
+func (bot *OpenAIChatBot) summarizeText(ctx context.Context, meta requestMeta, model, instruction, text string) (string, error) {
+	resp, err := bot.createChatCompletion(ctx, meta, openai.ChatCompletionRequest{
+		Model: model,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: instruction + "\n\n" + untrustedNotice},
+			{Role: openai.ChatMessageRoleUser, Content: wrapUntrusted(text)},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Choices) == 0 {
+		return "", errors.New("chat completion returned no choices")
+	}
+	return strings.TrimSpace(resp.Choices[0].Message.Content), nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/ewohltman/discordgo-mock/mockconstants"
+)
+
+// serveHistory makes the session page through n messages of the channel, one per minute up to now.
+// Message IDs count up from 1 like snowflakes.
+func serveHistory(s *discordgo.Session, n int, now time.Time) {
+	next := s.Client.Transport
+	s.Client.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Method != http.MethodGet || !strings.HasSuffix(req.URL.Path, "/messages") {
+			return next.RoundTrip(req)
+		}
+		limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
+		newest := n
+		if before := req.URL.Query().Get("before"); before != "" {
+			newest, _ = strconv.Atoi(before)
+			newest--
+		}
+		var page []*discordgo.Message
+		for id := newest; id >= 1 && len(page) < limit; id-- {
+			page = append(page, &discordgo.Message{
+				ID:        strconv.Itoa(id),
+				Content:   fmt.Sprint("message ", id),
+				Author:    &discordgo.User{Username: "user"},
+				Timestamp: now.Add(-time.Duration(n-id) * time.Minute),
+			})
+		}
+		b, _ := json.Marshal(page)
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(string(b))), Header: http.Header{}, Request: req}, nil
+	})
+}
+
+func TestFetchHistory(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name  string
+		limit int
+		since time.Time
+		first string
+		last  string
+		count int
+	}{
+		{"Limit", 150, time.Time{}, "101", "250", 150},
+		{"All", 1000, time.Time{}, "1", "250", 250},
+		{"Since", 1000, now.Add(-119*time.Minute - time.Second), "131", "250", 120},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newSession()
+			serveHistory(s, 250, now)
+			msgs, err := fetchHistory(s, mockconstants.TestChannel, test.limit, test.since)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(msgs) != test.count || msgs[0].ID != test.first || msgs[len(msgs)-1].ID != test.last {
+				t.Errorf("expected %d messages from %s to %s, got %d from %s to %s",
+					test.count, test.first, test.last, len(msgs), msgs[0].ID, msgs[len(msgs)-1].ID)
+			}
+		})
+	}
+}
+
+func TestChunkLines(t *testing.T) {
+	lines := []string{strings.Repeat("a", 40), strings.Repeat("b", 40), strings.Repeat("c", 200)}
+	chunks := chunkLines(lines, 100)
+	if len(chunks) != 2 || chunks[0] != lines[0]+"\n"+lines[1]+"\n" {
+		t.Fatalf("unexpected chunks %q", chunks)
+	}
+	if len(chunks[1]) > 100 {
+		t.Errorf("expected long lines to be truncated, got %d bytes", len(chunks[1]))
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	s := newSession()
+	g, err := s.State.Guild(mockconstants.TestGuild)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Roles[0].Permissions = discordgo.PermissionViewChannel | discordgo.PermissionReadMessageHistory
+	ch, err := s.State.Channel(mockconstants.TestChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// newest first like the API, long enough for three requests
+	for n := 30; n > 0; n-- {
+		ch.Messages = append(ch.Messages, &discordgo.Message{
+			ID:      strconv.Itoa(n),
+			Content: fmt.Sprintf("message %d %s", n, strings.Repeat("x", 1000)),
+			Author:  &discordgo.User{Username: "user"},
+		})
+	}
+	ch.Messages = append(ch.Messages, &discordgo.Message{ID: "0", Author: &discordgo.User{Username: "user"}})
+	fake := newFakeOpenAI(t,
+		fakeResponse{Content: "part 1"}, fakeResponse{Content: "part 2"}, fakeResponse{Content: "part 3"},
+		fakeResponse{Content: "- the digest"},
+	)
+	bot, sender := newTestOpenAIChatBot(t, fake)
+	recordInteractions(s)
+
+	bot.Summarize(s, commandInteraction("summarize"))
+
+	reqs := fake.Requests()
+	if len(reqs) != 4 {
+		t.Fatalf("expected 3 map and 1 reduce requests, got %d", len(reqs))
+	}
+	if !strings.HasPrefix(reqs[0].Messages[1].Content, "<untrusted>\n[") || !strings.Contains(reqs[0].Messages[1].Content, "user: message 1 ") {
+		t.Errorf("expected the transcript in chronological order, got %q", truncate(reqs[0].Messages[1].Content, 100))
+	}
+	if !strings.HasPrefix(reqs[3].Messages[0].Content, summaryDigestPrompt) || reqs[3].Messages[1].Content != wrapUntrusted("part 1\npart 2\npart 3\n") {
+		t.Errorf("expected the summaries to be combined, got %#v", reqs[3].Messages)
+	}
+	if len(sender.Followups) != 1 || sender.Followups[0].Content != "**Summary of the last 30 messages**\n- the digest\n" {
+		t.Errorf("unexpected followups %#v", sender.Followups)
+	}
+}
+
+func TestSummarizeWithoutHistoryPermission(t *testing.T) {
+	s := newToolSession(t, discordgo.PermissionViewChannel)
+	fake := newFakeOpenAI(t)
+	bot, sender := newTestOpenAIChatBot(t, fake)
+	recordInteractions(s)
+
+	bot.Summarize(s, commandInteraction("summarize"))
+
+	if len(fake.Requests()) != 0 {
+		t.Errorf("expected no requests, got %d", len(fake.Requests()))
+	}
+	want := "You need permission to read the message history of this channel to summarize it."
+	if len(sender.Followups) != 1 || strings.TrimSpace(sender.Followups[0].Content) != want {
+		t.Errorf("expected followup %q, got %#v", want, sender.Followups)
+	}
+}
+
+func TestSummarizeModeration(t *testing.T) {
+	s := newToolSession(t, discordgo.PermissionViewChannel|discordgo.PermissionReadMessageHistory)
+	fake := newFakeOpenAI(t, fakeResponse{Content: "- lots of hate"})
+	bot, sender := newTestOpenAIChatBot(t, fake, WithModeration(ModerationConfig{Classifier: ModerationOpenAI, Action: ModerationBlock, Threshold: 0.5}))
+	recordInteractions(s)
+
+	bot.Summarize(s, commandInteraction("summarize"))
+
+	want := "The reply was withheld by moderation (hate)."
+	if len(sender.Followups) != 1 || strings.TrimSpace(sender.Followups[0].Content) != want {
+		t.Errorf("expected followup %q, got %#v", want, sender.Followups)
+	}
+	if got := fake.Moderated(); !slices.Equal(got, []string{"- lots of hate"}) {
+		t.Errorf("expected the digest to be moderated, got %#v", got)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// ToolContext describes where the model calling a tool was invoked from.
+type ToolContext struct {
+	Session   *discordgo.Session
+	GuildID   string
+	ChannelID string
+	// user whose message triggered the request
+	UserID string
+}
+
+// ToolHandler executes a tool call with the JSON arguments generated by the model.
+// The returned string is sent back to the model as the result of the call.
+type ToolHandler func(ctx context.Context, tc ToolContext, args json.RawMessage) (string, error)
+
+// Tool is a Go function the model can call.
+type Tool struct {
+	Name        string
+	Description string
+	// JSON Schema of the arguments
+	Parameters json.RawMessage
+	Handler    ToolHandler
+	// the result has no content of other people, so the model may keep calling tools after it.
+	// Results of other tools are delimited as untrusted and end the tool calls of the request.
+	Trusted bool
+}
+
+type ToolConfig struct {
+	// maximum number of rounds of tool calls before the model has to answer
+	MaxIterations int
+	// timeout of a single tool call
+	Timeout time.Duration
+}
+
+func toolConfigFromEnv() (ToolConfig, error) {
+	c := ToolConfig{}
+	var err error
+	if c.MaxIterations, err = envInt("TOOL_MAX_ITERATIONS", 5); err != nil {
+		return c, err
+	}
+	timeout, err := envInt("TOOL_TIMEOUT_SECONDS", 30)
+	if err != nil {
+		return c, err
+	}
+	c.Timeout = time.Duration(timeout) * time.Second
+	return c, nil
+}
+
+var toolNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// ToolRegistry holds the tools exposed to the model.
+type ToolRegistry struct {
+	mu    sync.RWMutex
+	tools map[string]Tool
+	order []string
+}
+
+func NewToolRegistry() *ToolRegistry {
+	return &ToolRegistry{tools: make(map[string]Tool)}
+}
+
+func (r *ToolRegistry) Register(t Tool) error {
+	if !toolNamePattern.MatchString(t.Name) {
+		return fmt.Errorf("invalid tool name %q: must match %s", t.Name, toolNamePattern)
+	}
+	if t.Handler == nil {
+		return fmt.Errorf("tool %q has no handler", t.Name)
+	}
+	if len(t.Parameters) == 0 {
+		t.Parameters = json.RawMessage(`{"type":"object","properties":{}}`)
+	}
+	var schema map[string]any
+	if err := json.Unmarshal(t.Parameters, &schema); err != nil {
+		return fmt.Errorf("parameters of tool %q must be a JSON Schema object: %w", t.Name, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.tools[t.Name]; exists {
+		return fmt.Errorf("tool %q is already registered", t.Name)
+	}
+	r.tools[t.Name] = t
+	r.order = append(r.order, t.Name)
+	return nil
+}
+
+// Len returns the number of registered tools
+func (r *ToolRegistry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.order)
+}
+
+// Trusted reports whether the result of the tool has no content of other people
+func (r *ToolRegistry) Trusted(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.tools[name].Trusted
+}
+
+// Definitions returns the registered tools in the format of the chat completion API.
+func (r *ToolRegistry) Definitions() []openai.Tool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var defs []openai.Tool
+	for _, name := range r.order {
+		t := r.tools[name]
+		defs = append(defs, openai.Tool{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        t.Name,
+				Description: t.Description,
+				Parameters:  t.Parameters,
+			},
+		})
+	}
+	return defs
+}
+
+// Call executes the tool call with the timeout. Errors are returned as the result so that the model can react to them.
+func (r *ToolRegistry) Call(ctx context.Context, tc ToolContext, call openai.ToolCall, timeout time.Duration) string {
+	r.mu.RLock()
+	t, exists := r.tools[call.Function.Name]
+	r.mu.RUnlock()
+	if !exists {
+		return fmt.Sprintf("error: unknown tool %q", call.Function.Name)
+	}
+	args := json.RawMessage(call.Function.Arguments)
+	if len(args) == 0 {
+		args = json.RawMessage("{}")
+	}
+	if !json.Valid(args) {
+		return "error: arguments are not valid JSON"
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	result, err := t.Handler(ctx, tc, args)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Sprintf("error: tool %q timed out", t.Name)
+	}
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return result
+}
+
+// registerDefaultTools registers the tools that need no access to Discord.
+func registerDefaultTools(r *ToolRegistry) error {
+	return r.Register(Tool{
+		Name:        "current_time",
+		Description: "Get the current date and time.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"timezone": {"type": "string", "description": "IANA time zone, e.g. Asia/Tokyo. Defaults to UTC."}
+			}
+		}`),
+		Handler: func(ctx context.Context, tc ToolContext, args json.RawMessage) (string, error) {
+			var p struct {
+				Timezone string `json:"timezone"`
+			}
+			if err := json.Unmarshal(args, &p); err != nil {
+				return "", err
+			}
+			loc := time.UTC
+			if p.Timezone != "" {
+				var err error
+				if loc, err = time.LoadLocation(p.Timezone); err != nil {
+					return "", err
+				}
+			}
+			return time.Now().In(loc).Format(time.RFC1123Z), nil
+		},
+		Trusted: true,
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ewohltman/discordgo-mock/mockconstants"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func echoTool(name string) Tool {
+	return Tool{
+		Name:       name,
+		Parameters: json.RawMessage(`{"type":"object","properties":{"text":{"type":"string"}}}`),
+		Handler: func(ctx context.Context, tc ToolContext, args json.RawMessage) (string, error) {
+			var p struct {
+				Text string `json:"text"`
+			}
+			err := json.Unmarshal(args, &p)
+			return "echo: " + p.Text + " from " + tc.UserID, err
+		},
+		Trusted: true,
+	}
+}
+
+func TestToolRegistryRegister(t *testing.T) {
+	tests := []struct {
+		name    string
+		tool    Tool
+		wantErr bool
+	}{
+		{"Valid", echoTool("echo"), false},
+		{"Duplicate", echoTool("echo"), true},
+		{"InvalidName", echoTool("echo tool"), true},
+		{"NoHandler", Tool{Name: "nohandler"}, true},
+		{"InvalidSchema", Tool{Name: "schema", Parameters: json.RawMessage(`[`), Handler: echoTool("x").Handler}, true},
+	}
+	r := NewToolRegistry()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := r.Register(test.tool)
+			if (err != nil) != test.wantErr {
+				t.Errorf("Register(%v) returned %v, want error: %v", test.tool.Name, err, test.wantErr)
+			}
+		})
+	}
+	if r.Len() != 1 {
+		t.Errorf("expected 1 registered tool, got %d", r.Len())
+	}
+}
+
+func TestToolRegistryCall(t *testing.T) {
+	r := NewToolRegistry()
+	r.Register(echoTool("echo"))
+	r.Register(Tool{
+		Name: "slow",
+		Handler: func(ctx context.Context, tc ToolContext, args json.RawMessage) (string, error) {
+			select {
+			case <-time.After(time.Second):
+				return "done", nil
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		},
+	})
+	tests := []struct {
+		name     string
+		call     openai.ToolCall
+		expected string
+	}{
+		{"Echo", fakeToolCall("1", "echo", map[string]string{"text": "hi"}), "echo: hi from user"},
+		{"Unknown", fakeToolCall("2", "missing", nil), `error: unknown tool "missing"`},
+		{"InvalidArguments", openai.ToolCall{ID: "3", Function: openai.FunctionCall{Name: "echo", Arguments: "{"}}, "error: arguments are not valid JSON"},
+		{"Timeout", fakeToolCall("4", "slow", nil), `error: tool "slow" timed out`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := r.Call(context.Background(), ToolContext{UserID: "user"}, test.call, 50*time.Millisecond)
+			if got != test.expected {
+				t.Errorf("Call = %q, want %q", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestReplyWithTools(t *testing.T) {
+	fake := newFakeOpenAI(t,
+		fakeResponse{ToolCalls: []openai.ToolCall{fakeToolCall("call_1", "echo", map[string]string{"text": "ping"})}},
+		fakeResponse{Content: "pong"},
+	)
+	tools := NewToolRegistry()
+	tools.Register(echoTool("echo"))
+	bot, sender := newTestOpenAIChatBot(t, fake, WithTools(tools, ToolConfig{MaxIterations: 3, Timeout: time.Second}))
+
+	bot.HandleReply(newSession(), mentionMessage("ping"))
+
+	got := sender.Messages[mockconstants.TestChannel]
+	if strings.Join(got, "|") != "Using tool `echo`…|pong\n" {
+		t.Errorf("unexpected messages %#v", got)
+	}
+	reqs := fake.Requests()
+	if len(reqs) != 2 || len(reqs[0].Tools) != 1 {
+		t.Fatalf("expected 2 requests with tools, got %#v", reqs)
+	}
+	last := reqs[1].Messages[len(reqs[1].Messages)-1]
+	if last.Role != openai.ChatMessageRoleTool || last.ToolCallID != "call_1" || last.Content != "echo: ping from "+mockconstants.TestUser {
+		t.Errorf("unexpected tool result %#v", last)
+	}
+	// the tool calls are kept in the context
+	if c := bot.chatContext[mockconstants.TestChannel]; len(c.Messages) != 5 {
+		t.Errorf("expected 5 messages in the context, got %#v", c.Messages)
+	}
+}
+
+func TestReplyToolIterationLimit(t *testing.T) {
+	call := fakeResponse{ToolCalls: []openai.ToolCall{fakeToolCall("call", "echo", nil)}}
+	fake := newFakeOpenAI(t, call, call, fakeResponse{Content: "gave up"})
+	tools := NewToolRegistry()
+	tools.Register(echoTool("echo"))
+	bot, _ := newTestOpenAIChatBot(t, fake, WithTools(tools, ToolConfig{MaxIterations: 2}))
+
+	reply, err := bot.Reply("loop", newSession(), mentionMessage("loop"))
+	if err != nil || reply != "gave up" {
+		t.Fatalf("Reply = %q, %v", reply, err)
+	}
+	reqs := fake.Requests()
+	if len(reqs) != 3 || reqs[2].ToolChoice != "none" {
+		t.Errorf("expected the last request to disable tools, got %#v", reqs)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// how long usage records are kept in memory, enough for the longest /usage period
+const usageRetention = 31 * 24 * time.Hour
+
+// number of entries listed per breakdown of /usage
+const usageTopN = 10
+
+// periods of the /usage command
+var usagePeriods = map[string]time.Duration{
+	"day":   24 * time.Hour,
+	"week":  7 * 24 * time.Hour,
+	"month": 30 * 24 * time.Hour,
+}
+
+var usageCommand = &discordgo.ApplicationCommand{
+	Name:        "usage",
+	Description: "show the token usage of this server",
+	Options: []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "period",
+			Description: "period to show (default day)",
+			Choices: []*discordgo.ApplicationCommandOptionChoice{
+				{Name: "last 24 hours", Value: "day"},
+				{Name: "last 7 days", Value: "week"},
+				{Name: "last 30 days", Value: "month"},
+			},
+		},
+	},
+}
+
+// ModelPrice is the price of a model in USD per million tokens
+type ModelPrice struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+// PriceTable maps model names to their prices.
+// A model without an exact entry uses the longest entry it starts with, e.g. "gpt-5.2-2025-12-11" uses "gpt-5.2".
+type PriceTable map[string]ModelPrice
+
+func loadPriceTable(path string) (PriceTable, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var prices PriceTable
+	if err := json.Unmarshal(b, &prices); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return prices, nil
+}
+
+// Cost returns the cost of the tokens in USD and whether the model has a price
+func (p PriceTable) Cost(model string, promptTokens, completionTokens int) (float64, bool) {
+	price, ok := p[model]
+	if !ok {
+		best := ""
+		for name := range p {
+			if strings.HasPrefix(model, name) && len(name) > len(best) {
+				best = name
+			}
+		}
+		if best == "" {
+			return 0, false
+		}
+		price = p[best]
+	}
+	return (float64(promptTokens)*price.Input + float64(completionTokens)*price.Output) / 1e6, true
+}
+
+type UsageConfig struct {
+	// path of the JSONL file the usage is persisted to. Usage is only kept in memory if empty.
+	Path   string
+	Prices PriceTable
+}
+
+func usageConfigFromEnv() (UsageConfig, error) {
+	c := UsageConfig{Path: os.Getenv("USAGE_LOG")}
+	if path := os.Getenv("USAGE_PRICES"); path != "" {
+		var err error
+		if c.Prices, err = loadPriceTable(path); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+// One line of the usage log
+type UsageRecord struct {
+	Time             time.Time `json:"time"`
+	Kind             string    `json:"kind"`
+	GuildID          string    `json:"guild_id,omitempty"`
+	ChannelID        string    `json:"channel_id,omitempty"`
+	UserID           string    `json:"user_id,omitempty"`
+	Model            string    `json:"model"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	// estimated cost in USD, nil if the model has no price
+	Cost *float64 `json:"cost_usd,omitempty"`
+}
+
+// UsageTotal is the sum of usage records
+type UsageTotal struct {
+	Requests         int
+	PromptTokens     int
+	CompletionTokens int
+	Cost             float64
+	// number of requests whose cost is unknown
+	Unpriced int
+}
+
+func (t *UsageTotal) add(r UsageRecord) {
+	t.Requests++
+	t.PromptTokens += r.PromptTokens
+	t.CompletionTokens += r.CompletionTokens
+	if r.Cost != nil {
+		t.Cost += *r.Cost
+	} else {
+		t.Unpriced++
+	}
+}
+
+func (t *UsageTotal) Tokens() int {
+	return t.PromptTokens + t.CompletionTokens
+}
+
+func (t *UsageTotal) String() string {
+	cost := fmt.Sprintf("$%.4f", t.Cost)
+	switch {
+	case t.Unpriced == t.Requests:
+		cost = "cost unknown"
+	case t.Unpriced > 0:
+		cost = fmt.Sprintf("at least $%.4f", t.Cost)
+	}
+	return fmt.Sprintf("%d tokens (%d prompt, %d completion), %s in %d requests",
+		t.Tokens(), t.PromptTokens, t.CompletionTokens, cost, t.Requests)
+}
+
+// UsageStore records the token usage of the API requests and persists it to a JSONL file.
+type UsageStore struct {
+	path   string
+	prices PriceTable
+
+	mu      sync.Mutex
+	records []UsageRecord
+}
+
+// NewUsageStore returns a store loaded with the recent records of the file at c.Path.
+func NewUsageStore(c UsageConfig) (*UsageStore, error) {
+	u := &UsageStore{path: c.Path, prices: c.Prices}
+	if c.Path == "" {
+		return u, nil
+	}
+	f, err := os.Open(c.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return u, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cutoff := time.Now().Add(-usageRetention)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		var r UsageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", c.Path, n, err)
+		}
+		if r.Time.After(cutoff) {
+			u.records = append(u.records, r)
+		}
+	}
+	return u, scanner.Err()
+}
+
+// Record adds the usage of a request to the store and returns the record
+func (u *UsageStore) Record(meta requestMeta, model string, usage openai.Usage) (UsageRecord, error) {
+	r := UsageRecord{
+		Time:             time.Now().UTC(),
+		Kind:             meta.Kind,
+		GuildID:          meta.GuildID,
+		ChannelID:        meta.ChannelID,
+		UserID:           meta.UserID,
+		Model:            model,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+	}
+	if cost, ok := u.prices.Cost(model, usage.PromptTokens, usage.CompletionTokens); ok {
+		r.Cost = &cost
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	// drop the records too old to be shown
+	cutoff := r.Time.Add(-usageRetention)
+	n := sort.Search(len(u.records), func(i int) bool { return u.records[i].Time.After(cutoff) })
+	u.records = append(u.records[n:], r)
+
+	if u.path == "" {
+		return r, nil
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return r, err
+	}
+	f, err := os.OpenFile(u.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return r, err
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	return r, err
+}
+
+// Sum returns the totals of the records since the given time matching the filter, grouped by key.
+func (u *UsageStore) Sum(since time.Time, match func(UsageRecord) bool, key func(UsageRecord) string) map[string]*UsageTotal {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	totals := make(map[string]*UsageTotal)
+	for _, r := range u.records {
+		if r.Time.Before(since) || !match(r) {
+			continue
+		}
+		k := key(r)
+		if totals[k] == nil {
+			totals[k] = &UsageTotal{}
+		}
+		totals[k].add(r)
+	}
+	return totals
+}
+
+// Report returns the usage of the guild since the given time broken down by model, user and channel.
+func (u *UsageStore) Report(guildID string, since time.Time) string {
+	inGuild := func(r UsageRecord) bool { return r.GuildID == guildID }
+	total := u.Sum(since, inGuild, func(UsageRecord) string { return "" })[""]
+	if total == nil {
+		return "No usage recorded."
+	}
+	var sb strings.Builder
+	sb.WriteString("Total: " + total.String() + "\n")
+	sections := []struct {
+		title  string
+		key    func(UsageRecord) string
+		format string
+	}{
+		{"By model", func(r UsageRecord) string { return r.Model }, "%s"},
+		{"By user", func(r UsageRecord) string { return r.UserID }, "<@%s>"},
+		{"By channel", func(r UsageRecord) string { return r.ChannelID }, "<#%s>"},
+	}
+	for _, sec := range sections {
+		totals := u.Sum(since, inGuild, sec.key)
+		keys := make([]string, 0, len(totals))
+		for k := range totals {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if a, b := totals[keys[i]].Tokens(), totals[keys[j]].Tokens(); a != b {
+				return a > b
+			}
+			return keys[i] < keys[j]
+		})
+		fmt.Fprintf(&sb, "\n**%s**\n", sec.title)
+		for n, k := range keys {
+			if n == usageTopN {
+				fmt.Fprintf(&sb, "- and %d more\n", len(keys)-n)
+				break
+			}
+			name := "unknown"
+			if k != "" {
+				name = fmt.Sprintf(sec.format, k)
+			}
+			fmt.Fprintf(&sb, "- %s: %s\n", name, totals[k])
+		}
+	}
+	return sb.String()
+}
+
+// functional option to account the token usage of the requests.
+// Usage is only kept in memory if c.Path is empty.
+func WithUsage(c UsageConfig) ChatBotOption {
+	return func(s *OpenAIChatBot) {
+		u, err := NewUsageStore(c)
+		if err != nil {
+			s.logger.Fatal("Error loading usage log: ", err)
+		}
+		s.usage = u
+	}
+}
+
+// recordUsage adds the usage of a request to the store and its cost to the budget if any, logging failures
+func (bot *OpenAIChatBot) recordUsage(meta requestMeta, model string, usage openai.Usage) {
+	r, err := bot.usage.Record(meta, model, usage)
+	if err != nil {
+		bot.logger.Println("Error writing usage log:", err)
+	}
+	if r.Cost != nil {
+		bot.spend(meta, *r.Cost)
+	} else if bot.budget.Load() != nil {
+		bot.logger.Println("Model", model, "has no price in USAGE_PRICES, its usage does not count towards the budget")
+	}
+}
+
+// ShowUsage handles the /usage command.
+func (bot *OpenAIChatBot) ShowUsage(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	period := "day"
+	for _, o := range i.ApplicationCommandData().Options {
+		if o.Name == "period" {
+			period = o.StringValue()
+		}
+	}
+	content := "Usage is only recorded in servers."
+	if d, ok := usagePeriods[period]; !ok {
+		content = fmt.Sprintf("Unknown period `%s`.", period)
+	} else if i.GuildID != "" {
+		content = fmt.Sprintf("**Usage of this server in the last %s**\n", period) + bot.usage.Report(i.GuildID, time.Now().Add(-d))
+		// the budget covers all servers, so it is only shown to the admins of the bot
+		if budget := bot.budget.Load(); budget != nil && budget.config.AdminGuild == i.GuildID {
+			content += "\n" + budget.String()
+		}
+	}
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: truncate(content, 1990),
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		bot.logger.Println("Error responding to interaction:", err)
+	}
+}
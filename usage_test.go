@@ -0,0 +1,107 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ewohltman/discordgo-mock/mockconstants"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestPriceTableCost(t *testing.T) {
+	prices := PriceTable{
+		"gpt-5":      {Input: 1, Output: 10},
+		"gpt-5.2":    {Input: 2, Output: 20},
+		"test-model": {Input: 0.5, Output: 1},
+	}
+	tests := []struct {
+		model  string
+		cost   float64
+		priced bool
+	}{
+		{"test-model", 1.5, true},
+		{"gpt-5.2", 22, true},
+		{"gpt-5.2-2025-12-11", 22, true},
+		{"gpt-5-mini", 11, true},
+		{"other", 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.model, func(t *testing.T) {
+			cost, priced := prices.Cost(test.model, 1_000_000, 1_000_000)
+			if priced != test.priced || math.Abs(cost-test.cost) > 1e-9 {
+				t.Errorf("expected %v %v, got %v %v", test.cost, test.priced, cost, priced)
+			}
+		})
+	}
+}
+
+func TestUsageStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	config := UsageConfig{Path: path, Prices: PriceTable{defaultModel: {Input: 1, Output: 2}}}
+	fake := newFakeOpenAI(t,
+		fakeResponse{Content: "Hi!", Usage: openai.Usage{PromptTokens: 100, CompletionTokens: 50, TotalTokens: 150}},
+		fakeResponse{Content: "4", Usage: openai.Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15}},
+	)
+	bot, _ := newTestOpenAIChatBot(t, fake, WithUsage(config))
+	s := newSession()
+	recorder := recordInteractions(s)
+
+	bot.HandleReply(s, mentionMessage("hello"))
+	bot.Ask(s, commandInteraction("ask", stringOption("question", "2+2?")))
+
+	// the usage survives a restart
+	reloaded, err := NewUsageStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := reloaded.Sum(time.Now().Add(-time.Hour), func(r UsageRecord) bool { return r.GuildID == mockconstants.TestGuild },
+		func(r UsageRecord) string { return r.UserID })[mockconstants.TestUser]
+	if total == nil || total.Requests != 2 || total.Tokens() != 165 || math.Abs(total.Cost-0.00022) > 1e-9 {
+		t.Fatalf("unexpected total %+v", total)
+	}
+	if other := reloaded.Report("other guild", time.Now().Add(-time.Hour)); other != "No usage recorded." {
+		t.Errorf("expected no usage of another guild, got %q", other)
+	}
+
+	bot.ShowUsage(s, commandInteraction("usage", stringOption("period", "week")))
+	got := recorder.Responses()
+	if len(got) != 2 {
+		t.Fatalf("expected 2 interaction responses, got %#v", got)
+	}
+	for _, want := range []string{
+		"last week",
+		"Total: 165 tokens (110 prompt, 55 completion), $0.0002 in 2 requests",
+		"- " + defaultModel + ": 165 tokens",
+		"- <@" + mockconstants.TestUser + ">: 165 tokens",
+		"- <#" + mockconstants.TestChannel + ">: 165 tokens",
+	} {
+		if !strings.Contains(got[1], want) {
+			t.Errorf("expected %q in the report, got %q", want, got[1])
+		}
+	}
+}
+
+func TestUsageStoreRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	old := time.Now().Add(-usageRetention - time.Hour).UTC().Format(time.RFC3339)
+	recent := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	content := `{"time":"` + old + `","kind":"reply","guild_id":"g","model":"m","prompt_tokens":1,"completion_tokens":1}` + "\n" +
+		`{"time":"` + recent + `","kind":"reply","guild_id":"g","model":"m","prompt_tokens":2,"completion_tokens":2}` + "\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	u, err := NewUsageStore(UsageConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(u.records) != 1 || u.records[0].PromptTokens != 2 {
+		t.Errorf("expected only the recent record to be loaded, got %+v", u.records)
+	}
+	if report := u.Report("g", time.Time{}); !strings.Contains(report, "4 tokens (2 prompt, 2 completion), cost unknown in 1 requests") {
+		t.Errorf("unexpected report %q", report)
+	}
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"container/list"
+	"fmt"
+	"os"
+	"strconv"
 	"strings"
 	"unicode/utf8"
 )
@@ -91,3 +94,76 @@ func splitMessage(input string, maxLen int) []string {
 
 	return results
 }
+
+// envString returns the value of the environment variable or def if it is unset or empty.
+func envString(name string, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// envInt returns the integer value of the environment variable or def if it is unset or empty.
+func envInt(name string, def int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return def, fmt.Errorf("%s must be an integer, got %q", name, v)
+	}
+	return n, nil
+}
+
+// envFloat returns the numeric value of the environment variable or def if it is unset or empty.
+func envFloat(name string, def float64) (float64, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return def, fmt.Errorf("%s must be a number, got %q", name, v)
+	}
+	return f, nil
+}
+
+// envList returns the comma separated values of the environment variable with blanks removed.
+func envList(name string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// truncate shortens s to at most n bytes without breaking UTF-8 sequences.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + "…"
+}
+
+// envSecret returns the value of the environment variable, or the content of the file named by the variable
+// with the suffix _FILE such as the secrets mounted by Docker and Kubernetes. Surrounding blanks are removed.
+func envSecret(name string) (string, error) {
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return os.Getenv(name), nil
+	}
+	if os.Getenv(name) != "" {
+		return "", fmt.Errorf("only one of %s and %s_FILE may be set", name, name)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("%s_FILE: %w", name, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}